@@ -0,0 +1,3 @@
+module example.com/alak-common
+
+go 1.23
@@ -0,0 +1,452 @@
+// Package rules is the rule schema shared by all three services: the Rule and
+// Meta types, the key a rule is stored under and the keys a client is matched
+// against. Keeping both sides of the key schema here is what stops the
+// controller from writing keys the gatekeeper never looks up.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Returned (wrapped, with the key) by Resolve for undecodable rule values
+var ErrCorruptRule = errors.New("corrupt rule JSON")
+
+type Rule struct {
+	ASN         string `json:"asn"`
+	Country     string `json:"country"`
+	TSP         string `json:"tsp"`
+	City        string `json:"city"`
+	DropPercent int    `json:"drop_percent"`
+	DropMode    string `json:"drop_mode,omitempty"` // "sticky" (default, IP-hash) or "random" (per request)
+	TTL         int    `json:"ttl"`                 // seconds (optional)
+	Enabled     bool   `json:"enabled"`
+	Shadow      bool   `json:"shadow,omitempty"`       // gatekeeper counts would-be drops but allows
+	RedirectURL string `json:"redirect_url,omitempty"` // 302 dropped clients here (e.g. a challenge page)
+	Combine     string `json:"combine,omitempty"`      // with the next broader match: "override" (default), "add" or "max"
+	TarpitMs    int    `json:"tarpit_ms,omitempty"`    // hold dropped requests this long before answering
+	UAClass     string `json:"ua_class,omitempty"`     // only clients of this ClassifyUA class; empty = any
+
+	// Finer-grained rate, 0–1000 (5 = 0.5%). When set it replaces
+	// DropPercent, and sticky mode buckets IPs by HashIPPerMille instead.
+	DropPerMille *int `json:"drop_per_mille,omitempty"`
+
+	// Operator context, stored and returned verbatim; never used for matching
+	Note   string            `json:"note,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Unix seconds, set by the controller on every write; client values
+	// are ignored. CreatedAt is 0 for rules written before it existed.
+	CreatedAt int64 `json:"created_at,omitempty"`
+	UpdatedAt int64 `json:"updated_at,omitempty"`
+
+	// Optional daily window in which the rule applies: [start_hour, end_hour)
+	// in Timezone (default: the caller's). start > end wraps past midnight;
+	// both unset means always.
+	StartHour *int   `json:"start_hour,omitempty"`
+	EndHour   *int   `json:"end_hour,omitempty"`
+	Timezone  string `json:"timezone,omitempty"`
+}
+
+// Geo enrichment for a client, as returned by alak-geo's /lookup
+type Meta struct {
+	ASN     string `json:"asn"`
+	Country string `json:"country"`
+	TSP     string `json:"tsp"`
+	City    string `json:"city"`
+
+	// Set by the gatekeeper from the request (UA_RULES), never by geo
+	UAClass string `json:"ua_class,omitempty"`
+}
+
+var locations sync.Map // name → *time.Location
+
+// Reports whether the rule's schedule covers t. No window means always;
+// start > end wraps past midnight (22→6 covers 22:00–05:59); start == end
+// covers the whole day. No or unknown timezone falls back to def.
+func (r Rule) ActiveAt(t time.Time, def *time.Location) bool {
+	if r.StartHour == nil || r.EndHour == nil {
+		return true
+	}
+	loc := def
+	if r.Timezone != "" {
+		if l, err := loadLocation(r.Timezone); err == nil {
+			loc = l
+		}
+	}
+	h, start, end := t.In(loc).Hour(), *r.StartHour, *r.EndHour
+	switch {
+	case start == end:
+		return true
+	case start < end:
+		return h >= start && h < end
+	default:
+		return h >= start || h < end
+	}
+}
+
+// sticky: the same IPs always fall in the dropped slice (IP-hash bucket).
+// random: each request is dropped independently with DropPercent chance,
+// shedding a true share of request volume regardless of source.
+func (r Rule) ShouldDrop(ip string) bool {
+	if r.DropPerMille != nil {
+		if r.DropMode == "random" {
+			return rand.IntN(1000) < *r.DropPerMille
+		}
+		return HashIPPerMille(ip) < *r.DropPerMille
+	}
+	if r.DropMode == "random" {
+		return rand.IntN(100) < r.DropPercent
+	}
+	return HashIP(ip) < r.DropPercent
+}
+
+// Drop rate in percent, fractional for DropPerMille rules (5‰ → 0.5)
+func (r Rule) DropRate() float64 {
+	if r.DropPerMille != nil {
+		return float64(*r.DropPerMille) / 10
+	}
+	return float64(r.DropPercent)
+}
+
+// User-Agent classes a rule's ua_class can target
+const (
+	UABot     = "bot"
+	UABrowser = "browser"
+	UAUnknown = "unknown"
+)
+
+// "…bot" as a word (Googlebot/2.1, AhrefsBot, Slackbot-LinkExpanding) or
+// one of the usual crawler, HTTP library and headless-browser tokens
+var botUA = regexp.MustCompile(`(?i)bot\b|crawl|spider|slurp|scrapy|curl/|wget/|python-|go-http-client|java/|okhttp|libwww|httpclient|axios/|node-fetch|aiohttp|headless|phantomjs|facebookexternalhit`)
+
+// Rough class of a User-Agent for ua_class rules: bot for the tokens above,
+// browser for Mozilla/ agents naming a rendering engine, unknown for the
+// rest, including no User-Agent at all. A heuristic, not a defense: any
+// client can send a browser's string.
+func ClassifyUA(ua string) string {
+	switch {
+	case botUA.MatchString(ua) && !strings.Contains(strings.ToLower(ua), "cubot"): // a phone brand
+		return UABot
+	case strings.HasPrefix(ua, "Mozilla/") && (strings.Contains(ua, "AppleWebKit/") || strings.Contains(ua, "Gecko/") || strings.Contains(ua, "Trident/")):
+		return UABrowser
+	}
+	return UAUnknown
+}
+
+// Sticky-mode bucket of an IP, 0–99
+func HashIP(ip string) int {
+	return int(fnvIP(ip) % 100)
+}
+
+// Sticky-mode bucket of an IP for DropPerMille rules, 0–999
+func HashIPPerMille(ip string) int {
+	return int(fnvIP(ip) % 1000)
+}
+
+func fnvIP(ip string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(ip))
+	return h.Sum32()
+}
+
+// Trims geo fields, maps "-" to empty and folds case the way the controller
+// normalizes rules before writing them (country upper, TSP and city lower).
+func CleanMeta(m Meta) Meta {
+	return Meta{
+		ASN:     cleanField(m.ASN),
+		Country: strings.ToUpper(cleanField(m.Country)),
+		TSP:     strings.ToLower(cleanField(m.TSP)),
+		City:    strings.ToLower(cleanField(m.City)),
+		UAClass: m.UAClass,
+	}
+}
+
+func cleanField(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "-" {
+		s = ""
+	}
+	return s
+}
+
+// Legal-form words dropped from the end of an AS organization name
+var tspSuffixes = map[string]bool{
+	"llc": true, "inc": true, "ltd": true, "limited": true, "co": true,
+	"corp": true, "corporation": true, "company": true, "plc": true,
+	"gmbh": true, "ag": true, "sa": true, "sas": true, "srl": true,
+	"bv": true, "nv": true, "ab": true, "as": true, "oy": true,
+	"jsc": true, "pjsc": true, "ojsc": true, "llp": true, "lp": true,
+}
+
+// Canonical TSP name for an AS organization, so rule keys don't depend on
+// punctuation or legal form: "Comcast Cable Communications, LLC." becomes
+// "comcast cable communications". Lowercases, turns every run of
+// non-alphanumerics into one space and strips trailing legal suffixes
+// (never the last remaining word). "*" is kept as the wildcard.
+func NormalizeTSP(org string) string {
+	if strings.TrimSpace(org) == "*" {
+		return "*"
+	}
+	words := strings.FieldsFunc(strings.ToLower(org), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for len(words) > 1 && tspSuffixes[words[len(words)-1]] {
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
+// Segments are escaped so a TSP like "foo:bar telecom" can't add a
+// separator: "%" → "%25", ":" → "%3A", and "=" → "%3D" so no segment reads
+// as the ua= suffix. Keys without any of them are unchanged.
+var segmentEscaper = strings.NewReplacer("%", "%25", ":", "%3A", "=", "%3D")
+
+func makeKey(segments ...string) string {
+	for i, seg := range segments {
+		segments[i] = segmentEscaper.Replace(seg)
+	}
+	return "rule:" + strings.Join(segments, ":")
+}
+
+// Where a rule is stored: rule:ASN:COUNTRY:TSP, or rule:ASN:COUNTRY:TSP:CITY
+// for city-scoped rules, plus ":ua=CLASS" for a UAClass. "*" segments are
+// stored literally as wildcards.
+func Key(r Rule) string {
+	if r.City != "" {
+		return makeKey(r.ASN, r.Country, r.TSP, r.City) + uaSuffix(r.UAClass)
+	}
+	return makeKey(r.ASN, r.Country, r.TSP) + uaSuffix(r.UAClass)
+}
+
+func uaSuffix(class string) string {
+	if class == "" {
+		return ""
+	}
+	return ":ua=" + class
+}
+
+// Inverse of Key: the unescaped fields of a rule key, ok=false for anything
+// that isn't one.
+func ParseKey(key string) (m Meta, ok bool) {
+	rest, ok := strings.CutPrefix(key, "rule:")
+	if !ok {
+		return m, false
+	}
+	parts := strings.Split(rest, ":")
+	if class, ok := strings.CutPrefix(parts[len(parts)-1], "ua="); ok {
+		m.UAClass = class
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) != 3 && len(parts) != 4 {
+		return m, false
+	}
+	for i, p := range parts {
+		v, err := url.PathUnescape(p)
+		if err != nil {
+			return m, false
+		}
+		parts[i] = v
+	}
+	m.ASN, m.Country, m.TSP = parts[0], parts[1], parts[2]
+	if len(parts) == 4 {
+		m.City = parts[3]
+	}
+	return m, true
+}
+
+// Candidate keys for a client, most specific first. City-scoped keys form
+// the top tier, ahead of the 3-part keys. Every key listed must be one Key
+// can produce. Missing fields only drop the tiers that need them: with no
+// country (geo had none, not even its ASN fallback) an ASN client is still
+// matched by its ASN rules and rule:*:*:*; with no TSP, by rule:ASN:CC:*,
+// rule:ASN:*:* and, since its ASN tier is incomplete, rule:*:CC:*. Only a
+// client with both ASN and TSP leaves rule:*:CC:* to its ASN rules. With a UAClass every key is preceded by its ":ua="
+// variant, so the UA narrows a geo match but never outranks a more
+// specific geo key.
+func LookupKeys(meta Meta) []string {
+	keys := geoKeys(meta)
+	if meta.UAClass == "" {
+		return keys
+	}
+	out := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		out = append(out, k+uaSuffix(meta.UAClass), k)
+	}
+	return out
+}
+
+func geoKeys(meta Meta) []string {
+	var keys []string
+	asnSet := meta.ASN != ""
+	tspSet := meta.TSP != ""
+	countrySet := meta.Country != ""
+
+	if meta.City != "" {
+		if asnSet && countrySet {
+			if tspSet {
+				keys = append(keys, makeKey(meta.ASN, meta.Country, meta.TSP, meta.City))
+			}
+			keys = append(keys, makeKey(meta.ASN, meta.Country, "*", meta.City))
+		}
+		if countrySet {
+			keys = append(keys, makeKey("*", meta.Country, "*", meta.City))
+		}
+	}
+
+	if asnSet {
+		if countrySet {
+			if tspSet {
+				keys = append(keys, makeKey(meta.ASN, meta.Country, meta.TSP))
+			}
+			keys = append(keys, makeKey(meta.ASN, meta.Country, "*"))
+		}
+		if tspSet {
+			keys = append(keys, makeKey(meta.ASN, "*", meta.TSP))
+		}
+		keys = append(keys, makeKey(meta.ASN, "*", "*"))
+	}
+	if countrySet && !(asnSet && tspSet) {
+		keys = append(keys, makeKey("*", meta.Country, "*"))
+	}
+	keys = append(keys, makeKey("*", "*", "*"))
+	return keys
+}
+
+// Reports whether some client's LookupKeys would include Key(r), i.e. the
+// gatekeeper can ever read the rule. "*" is a wildcard only in the shapes
+// LookupKeys tries (rule:*:CC:TSP or a "*" city, for instance, never are).
+// A UAClass is reachable wherever its geo key is.
+func Reachable(r Rule) bool {
+	want := Key(r)
+	// A "*" (or, for city, absent) field may stand for any client value,
+	// including none at all; "?" is a value no rule field equals.
+	options := func(v string, open bool) []string {
+		if v == "*" || open {
+			return []string{"", "?"}
+		}
+		return []string{v}
+	}
+	for _, asn := range options(r.ASN, false) {
+		for _, cc := range options(r.Country, false) {
+			for _, tsp := range options(r.TSP, false) {
+				for _, city := range options(r.City, r.City == "") {
+					if slices.Contains(LookupKeys(Meta{ASN: asn, Country: cc, TSP: tsp, City: city, UAClass: r.UAClass}), want) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Result of Resolve. Rule is the most specific match, stored as-is; it
+// decides enabled, schedule, mode, shadow and redirect. DropPercent is the
+// effective percentage after combining with broader matches; if any rule in
+// the chain sets DropPerMille the fold runs in per-mille and DropPerMille
+// holds the exact result (DropPercent is then that rounded down).
+type Match struct {
+	Key          string
+	Rule         Rule
+	DropPercent  int
+	DropPerMille *int
+	Combined     []string // broader keys folded into DropPercent, most specific first
+}
+
+// Walks keys (most specific first) and returns the first rule get finds.
+// If that rule's Combine is "add" or "max" the walk goes on: the next
+// enabled, non-shadow rule active at t is folded in, and so on while each
+// folded rule itself says add or max. Folding runs from the broadest rule
+// back: add sums (capped at 100%), max keeps the larger, override keeps its
+// own. get reports (value, false, nil) for a missing key; its errors are
+// returned as-is, and an undecodable value yields ErrCorruptRule. A nil
+// Match with nil error means nothing matched.
+func Resolve(keys []string, t time.Time, def *time.Location, get func(key string) (string, bool, error)) (*Match, error) {
+	var (
+		m     *Match
+		chain []Rule // matched rules, most specific first
+	)
+	for _, key := range keys {
+		val, ok, err := get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		var rule Rule
+		if err := json.Unmarshal([]byte(val), &rule); err != nil {
+			return nil, fmt.Errorf("%w at %s: %v", ErrCorruptRule, key, err)
+		}
+		if m == nil {
+			m = &Match{Key: key, Rule: rule}
+		} else {
+			if !rule.Enabled || rule.Shadow || !rule.ActiveAt(t, def) {
+				continue // a broader rule that isn't enforcing adds nothing
+			}
+			m.Combined = append(m.Combined, key)
+		}
+		chain = append(chain, rule)
+		if rule.Combine != "add" && rule.Combine != "max" {
+			break
+		}
+	}
+	if m == nil {
+		return nil, nil
+	}
+	if slices.ContainsFunc(chain, func(r Rule) bool { return r.DropPerMille != nil }) {
+		pm := perMille(chain[len(chain)-1])
+		for i := len(chain) - 2; i >= 0; i-- {
+			pm = combine(chain[i].Combine, perMille(chain[i]), pm, 1000)
+		}
+		m.DropPercent, m.DropPerMille = pm/10, &pm
+		return m, nil
+	}
+	pct := chain[len(chain)-1].DropPercent
+	for i := len(chain) - 2; i >= 0; i-- {
+		pct = combine(chain[i].Combine, chain[i].DropPercent, pct, 100)
+	}
+	m.DropPercent = pct
+	return m, nil
+}
+
+func perMille(r Rule) int {
+	if r.DropPerMille != nil {
+		return *r.DropPerMille
+	}
+	return r.DropPercent * 10
+}
+
+func combine(mode string, own, broader, limit int) int {
+	switch mode {
+	case "add":
+		return min(own+broader, limit)
+	case "max":
+		return max(own, broader)
+	default:
+		return own
+	}
+}
+
+func loadLocation(name string) (*time.Location, error) {
+	if v, ok := locations.Load(name); ok {
+		return v.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
@@ -0,0 +1,345 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Every key shape the controller accepts, each with a client that should
+// match it. The write side (Key) and the read side (LookupKeys) must agree
+// on every one of them.
+var reachableShapes = []struct {
+	name   string
+	rule   Rule
+	client Meta
+}{
+	{"asn country tsp", Rule{ASN: "44244", Country: "IR", TSP: "irancell"}, Meta{ASN: "44244", Country: "IR", TSP: "irancell"}},
+	{"asn country *", Rule{ASN: "44244", Country: "IR", TSP: "*"}, Meta{ASN: "44244", Country: "IR", TSP: "irancell"}},
+	{"asn country * no tsp", Rule{ASN: "44244", Country: "IR", TSP: "*"}, Meta{ASN: "44244", Country: "IR"}},
+	{"asn * tsp", Rule{ASN: "44244", Country: "*", TSP: "irancell"}, Meta{ASN: "44244", Country: "IR", TSP: "irancell"}},
+	{"asn * tsp no country", Rule{ASN: "44244", Country: "*", TSP: "irancell"}, Meta{ASN: "44244", TSP: "irancell"}},
+	{"asn * *", Rule{ASN: "44244", Country: "*", TSP: "*"}, Meta{ASN: "44244", Country: "IR", TSP: "irancell"}},
+	{"asn * * bare", Rule{ASN: "44244", Country: "*", TSP: "*"}, Meta{ASN: "44244"}},
+	{"* country *", Rule{ASN: "*", Country: "IR", TSP: "*"}, Meta{Country: "IR"}},
+	{"* * *", Rule{ASN: "*", Country: "*", TSP: "*"}, Meta{ASN: "44244", Country: "IR", TSP: "irancell"}},
+	{"* * * empty client", Rule{ASN: "*", Country: "*", TSP: "*"}, Meta{}},
+	{"city asn country tsp", Rule{ASN: "44244", Country: "IR", TSP: "irancell", City: "tehran"}, Meta{ASN: "44244", Country: "IR", TSP: "irancell", City: "tehran"}},
+	{"city asn country *", Rule{ASN: "44244", Country: "IR", TSP: "*", City: "tehran"}, Meta{ASN: "44244", Country: "IR", TSP: "irancell", City: "tehran"}},
+	{"city * country *", Rule{ASN: "*", Country: "IR", TSP: "*", City: "tehran"}, Meta{ASN: "44244", Country: "IR", TSP: "irancell", City: "tehran"}},
+	{"city * country * no asn", Rule{ASN: "*", Country: "IR", TSP: "*", City: "tehran"}, Meta{Country: "IR", City: "tehran"}},
+	{"escaped tsp", Rule{ASN: "1", Country: "US", TSP: "foo:bar 100%=x"}, Meta{ASN: "1", Country: "US", TSP: "foo:bar 100%=x"}},
+	{"ua class", Rule{ASN: "44244", Country: "IR", TSP: "*", UAClass: UABot}, Meta{ASN: "44244", Country: "IR", TSP: "irancell", UAClass: UABot}},
+	{"ua class city", Rule{ASN: "*", Country: "IR", TSP: "*", City: "tehran", UAClass: UABrowser}, Meta{Country: "IR", City: "tehran", UAClass: UABrowser}},
+}
+
+// Shapes LookupKeys never produces; the controller must refuse them.
+var unreachableShapes = []Rule{
+	{ASN: "*", Country: "IR", TSP: "irancell"},
+	{ASN: "*", Country: "*", TSP: "irancell"},
+	{ASN: "44244", Country: "*", TSP: "irancell", City: "tehran"},
+	{ASN: "44244", Country: "*", TSP: "*", City: "tehran"},
+	{ASN: "*", Country: "IR", TSP: "irancell", City: "tehran"},
+	{ASN: "*", Country: "*", TSP: "*", City: "tehran"},
+	{ASN: "44244", Country: "IR", TSP: "irancell", City: "*"},
+	{ASN: "*", Country: "IR", TSP: "*", City: "*"},
+	{ASN: "*", Country: "IR", TSP: "irancell", UAClass: UABot},
+}
+
+func TestKeyFoundByLookupKeys(t *testing.T) {
+	for _, tc := range reachableShapes {
+		t.Run(tc.name, func(t *testing.T) {
+			key := Key(tc.rule)
+			if !slices.Contains(LookupKeys(tc.client), key) {
+				t.Errorf("%s not in LookupKeys(%+v) = %q", key, tc.client, LookupKeys(tc.client))
+			}
+			if !Reachable(tc.rule) {
+				t.Errorf("Reachable(%s) = false", key)
+			}
+			m, ok := ParseKey(key)
+			want := Meta{ASN: tc.rule.ASN, Country: tc.rule.Country, TSP: tc.rule.TSP, City: tc.rule.City, UAClass: tc.rule.UAClass}
+			if !ok || m != want {
+				t.Errorf("ParseKey(%s) = %+v, %v; want %+v", key, m, ok, want)
+			}
+		})
+	}
+}
+
+func TestReachableRejectsUnlookedShapes(t *testing.T) {
+	// Every client LookupKeys can be asked about, per field: set, unset or
+	// a value no rule uses
+	asns := []string{"", "44244", "1"}
+	countries := []string{"", "IR", "US"}
+	tsps := []string{"", "irancell", "other", "foo:bar 100%=x"}
+	cities := []string{"", "tehran", "other"}
+	classes := []string{"", UABot, UABrowser}
+	looked := map[string]bool{}
+	for _, asn := range asns {
+		for _, cc := range countries {
+			for _, tsp := range tsps {
+				for _, city := range cities {
+					for _, ua := range classes {
+						for _, k := range LookupKeys(Meta{ASN: asn, Country: cc, TSP: tsp, City: city, UAClass: ua}) {
+							looked[k] = true
+						}
+					}
+				}
+			}
+		}
+	}
+	for _, r := range unreachableShapes {
+		key := Key(r)
+		if Reachable(r) {
+			t.Errorf("Reachable(%s) = true", key)
+		}
+		if looked[key] {
+			t.Errorf("%s is looked up, but listed as unreachable", key)
+		}
+	}
+	for _, tc := range reachableShapes {
+		if !looked[Key(tc.rule)] {
+			t.Errorf("%s is never looked up", Key(tc.rule))
+		}
+	}
+}
+
+// Full candidate lists for clients missing a field: the tiers that need it
+// go, the rest keep their order.
+func TestLookupKeysMissingFields(t *testing.T) {
+	cases := []struct {
+		name string
+		meta Meta
+		want []string
+	}{
+		{"complete", Meta{ASN: "44244", Country: "IR", TSP: "irancell"}, []string{
+			"rule:44244:IR:irancell", "rule:44244:IR:*", "rule:44244:*:irancell", "rule:44244:*:*", "rule:*:*:*",
+		}},
+		{"empty country", Meta{ASN: "44244", TSP: "irancell"}, []string{
+			"rule:44244:*:irancell", "rule:44244:*:*", "rule:*:*:*",
+		}},
+		{"empty tsp", Meta{ASN: "44244", Country: "IR"}, []string{
+			"rule:44244:IR:*", "rule:44244:*:*", "rule:*:IR:*", "rule:*:*:*",
+		}},
+		{"empty asn", Meta{Country: "IR", TSP: "irancell"}, []string{
+			"rule:*:IR:*", "rule:*:*:*",
+		}},
+		{"country only", Meta{Country: "IR"}, []string{
+			"rule:*:IR:*", "rule:*:*:*",
+		}},
+		{"empty tsp with city", Meta{ASN: "44244", Country: "IR", City: "tehran"}, []string{
+			"rule:44244:IR:*:tehran", "rule:*:IR:*:tehran",
+			"rule:44244:IR:*", "rule:44244:*:*", "rule:*:IR:*", "rule:*:*:*",
+		}},
+		{"empty", Meta{}, []string{"rule:*:*:*"}},
+	}
+	for _, tc := range cases {
+		if got := LookupKeys(tc.meta); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: LookupKeys(%+v) =\n  %q\nwant\n  %q", tc.name, tc.meta, got, tc.want)
+		}
+	}
+}
+
+// City keys are the most specific tier: each one comes before every 3-part
+// key, and within the tier the usual ASN > country order holds.
+func TestLookupKeysCityOrder(t *testing.T) {
+	cases := []struct {
+		name string
+		meta Meta
+		want []string
+	}{
+		{"complete", Meta{ASN: "44244", Country: "IR", TSP: "irancell", City: "tehran"}, []string{
+			"rule:44244:IR:irancell:tehran", "rule:44244:IR:*:tehran", "rule:*:IR:*:tehran",
+			"rule:44244:IR:irancell", "rule:44244:IR:*", "rule:44244:*:irancell", "rule:44244:*:*", "rule:*:*:*",
+		}},
+		{"no asn", Meta{Country: "IR", TSP: "irancell", City: "tehran"}, []string{
+			"rule:*:IR:*:tehran", "rule:*:IR:*", "rule:*:*:*",
+		}},
+		{"no country", Meta{ASN: "44244", TSP: "irancell", City: "tehran"}, []string{
+			"rule:44244:*:irancell", "rule:44244:*:*", "rule:*:*:*",
+		}},
+		{"ua class", Meta{ASN: "44244", Country: "IR", City: "tehran", UAClass: UABot}, []string{
+			"rule:44244:IR:*:tehran:ua=bot", "rule:44244:IR:*:tehran",
+			"rule:*:IR:*:tehran:ua=bot", "rule:*:IR:*:tehran",
+			"rule:44244:IR:*:ua=bot", "rule:44244:IR:*",
+			"rule:44244:*:*:ua=bot", "rule:44244:*:*",
+			"rule:*:IR:*:ua=bot", "rule:*:IR:*",
+			"rule:*:*:*:ua=bot", "rule:*:*:*",
+		}},
+	}
+	for _, tc := range cases {
+		if got := LookupKeys(tc.meta); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: LookupKeys(%+v) =\n  %q\nwant\n  %q", tc.name, tc.meta, got, tc.want)
+		}
+	}
+}
+
+func TestActiveAtBoundaries(t *testing.T) {
+	hours := func(start, end int) Rule { return Rule{StartHour: &start, EndHour: &end} }
+	at := func(h, m int) time.Time { return time.Date(2024, 3, 1, h, m, 0, 0, time.UTC) }
+	tehran, err := time.LoadLocation("Asia/Tehran") // UTC+3:30, no DST since 2022
+	if err != nil {
+		t.Fatal(err)
+	}
+	inTehran := hours(9, 17)
+	inTehran.Timezone = "Asia/Tehran"
+	badZone := hours(9, 17)
+	badZone.Timezone = "Nowhere/Special"
+
+	cases := []struct {
+		name string
+		rule Rule
+		t    time.Time
+		def  *time.Location
+		want bool
+	}{
+		{"no window", Rule{}, at(3, 0), time.UTC, true},
+		{"start only", Rule{StartHour: new(int)}, at(3, 0), time.UTC, true},
+		{"before start", hours(9, 17), at(8, 59), time.UTC, false},
+		{"at start", hours(9, 17), at(9, 0), time.UTC, true},
+		{"before end", hours(9, 17), at(16, 59), time.UTC, true},
+		{"at end", hours(9, 17), at(17, 0), time.UTC, false},
+		{"wrap before start", hours(22, 6), at(21, 59), time.UTC, false},
+		{"wrap at start", hours(22, 6), at(22, 0), time.UTC, true},
+		{"wrap midnight", hours(22, 6), at(0, 0), time.UTC, true},
+		{"wrap before end", hours(22, 6), at(5, 59), time.UTC, true},
+		{"wrap at end", hours(22, 6), at(6, 0), time.UTC, false},
+		{"start == end", hours(5, 5), at(12, 0), time.UTC, true},
+		{"default zone before start", hours(9, 17), at(5, 29), tehran, false},
+		{"default zone at start", hours(9, 17), at(5, 30), tehran, true},
+		{"rule zone before start", inTehran, at(5, 29), time.UTC, false},
+		{"rule zone at start", inTehran, at(5, 30), time.UTC, true},
+		{"rule zone at end", inTehran, at(13, 30), time.UTC, false},
+		{"unknown zone falls back", badZone, at(9, 0), time.UTC, true},
+	}
+	for _, tc := range cases {
+		if got := tc.rule.ActiveAt(tc.t, tc.def); got != tc.want {
+			t.Errorf("%s: ActiveAt(%s in %s) = %v, want %v", tc.name, tc.t.Format("15:04"), tc.def, got, tc.want)
+		}
+	}
+}
+
+// Random mode sheds a share of requests even from a single IP; sticky
+// mode decides the same way for an IP every time.
+func TestRandomDropRatio(t *testing.T) {
+	const n = 100000
+	for _, pct := range []int{0, 10, 30, 100} {
+		r := Rule{DropPercent: pct, DropMode: "random"}
+		dropped := 0
+		for i := 0; i < n; i++ {
+			if r.ShouldDrop("203.0.113.7") {
+				dropped++
+			}
+		}
+		if got := float64(dropped) / n * 100; got < float64(pct)-1 || got > float64(pct)+1 {
+			t.Errorf("random %d%%: dropped %.2f%% of requests", pct, got)
+		}
+	}
+
+	sticky := Rule{DropPercent: 30}
+	first := sticky.ShouldDrop("203.0.113.7")
+	for i := 0; i < 1000; i++ {
+		if sticky.ShouldDrop("203.0.113.7") != first {
+			t.Fatal("sticky mode changed its mind for the same IP")
+		}
+	}
+}
+
+func TestResolveCombine(t *testing.T) {
+	keys := []string{"rule:44244:IR:irancell", "rule:44244:*:*", "rule:*:*:*"}
+	rule := func(pct int, combine string) Rule {
+		return Rule{DropPercent: pct, Combine: combine, Enabled: true}
+	}
+	perMille := func(pm int, combine string) Rule {
+		r := rule(0, combine)
+		r.DropPerMille = &pm
+		return r
+	}
+	disabled := rule(50, "")
+	disabled.Enabled = false
+
+	cases := []struct {
+		name         string
+		chain        []Rule // stored at keys[:len(chain)]
+		wantPct      int
+		wantPerMille int // 0: no DropPerMille
+		wantCombined int
+	}{
+		{"override", []Rule{rule(20, ""), rule(50, "")}, 20, 0, 0},
+		{"explicit override", []Rule{rule(20, "override"), rule(50, "")}, 20, 0, 0},
+		{"add", []Rule{rule(20, "add"), rule(50, "")}, 70, 0, 1},
+		{"add capped", []Rule{rule(70, "add"), rule(50, "")}, 100, 0, 1},
+		{"max broader", []Rule{rule(20, "max"), rule(50, "")}, 50, 0, 1},
+		{"max own", []Rule{rule(60, "max"), rule(50, "")}, 60, 0, 1},
+		{"add chain", []Rule{rule(10, "add"), rule(20, "add"), rule(30, "")}, 60, 0, 2},
+		{"add then max", []Rule{rule(10, "add"), rule(20, "max"), rule(30, "")}, 40, 0, 2},
+		{"chain ends at override", []Rule{rule(10, "add"), rule(20, ""), rule(30, "")}, 30, 0, 1},
+		{"skips disabled broader", []Rule{rule(10, "add"), disabled, rule(30, "")}, 40, 0, 1},
+		{"add with nothing broader", []Rule{rule(10, "add")}, 10, 0, 0},
+		{"per mille add", []Rule{perMille(5, "add"), rule(1, "")}, 1, 15, 1},
+	}
+	for _, tc := range cases {
+		vals := map[string]string{}
+		for i, r := range tc.chain {
+			b, _ := json.Marshal(r)
+			vals[keys[i]] = string(b)
+		}
+		m, err := Resolve(keys, time.Now(), time.UTC, func(key string) (string, bool, error) {
+			v, ok := vals[key]
+			return v, ok, nil
+		})
+		if err != nil || m == nil {
+			t.Errorf("%s: Resolve = %v, %v", tc.name, m, err)
+			continue
+		}
+		if m.Key != keys[0] || m.DropPercent != tc.wantPct || len(m.Combined) != tc.wantCombined {
+			t.Errorf("%s: key %s, drop %d%%, combined %q; want %s, %d%%, %d keys", tc.name, m.Key, m.DropPercent, m.Combined, keys[0], tc.wantPct, tc.wantCombined)
+		}
+		if m.DropPerMille != nil {
+			if *m.DropPerMille != tc.wantPerMille {
+				t.Errorf("%s: drop %d‰, want %d‰", tc.name, *m.DropPerMille, tc.wantPerMille)
+			}
+		} else if tc.wantPerMille != 0 {
+			t.Errorf("%s: no per-mille rate, want %d‰", tc.name, tc.wantPerMille)
+		}
+	}
+}
+
+// A 5‰ sticky rule drops about 0.5% of a large IP sample; percent rules
+// keep bucketing by HashIP.
+func TestPerMilleRatio(t *testing.T) {
+	const n = 200000
+	ips := make([]string, n)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("%d.%d.%d.%d", 5+i>>16, i>>8&0xff, i&0xff, 1+i%7)
+	}
+	ratio := func(r Rule) float64 {
+		dropped := 0
+		for _, ip := range ips {
+			if r.ShouldDrop(ip) {
+				dropped++
+			}
+		}
+		return float64(dropped) / n * 1000
+	}
+	pm := func(v int) Rule { return Rule{DropPerMille: &v} }
+
+	if got := ratio(pm(5)); got < 4 || got > 6 {
+		t.Errorf("5‰ rule dropped %.2f‰ of IPs", got)
+	}
+	if got := ratio(pm(0)); got != 0 {
+		t.Errorf("0‰ rule dropped %.2f‰", got)
+	}
+	if got := ratio(pm(1000)); got != 1000 {
+		t.Errorf("1000‰ rule dropped %.2f‰", got)
+	}
+	if got := ratio(Rule{DropPercent: 1}); got < 8 || got > 12 {
+		t.Errorf("1%% rule dropped %.2f‰", got)
+	}
+	for _, ip := range ips[:1000] {
+		if (Rule{DropPercent: 30}).ShouldDrop(ip) != (HashIP(ip) < 30) {
+			t.Fatalf("percent rule on %s didn't bucket by HashIP", ip)
+		}
+	}
+}
@@ -1,41 +1,176 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata" // schedule timezones on slim images without tzdata
 
+	"example.com/alak-common/rules"
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type Rule struct {
-	ASN         string `json:"asn"`
-	Country     string `json:"country"`
-	TSP         string `json:"tsp"`
-	City        string `json:"city"`
-	DropPercent int    `json:"drop_percent"`
-	TTL         int    `json:"ttl"` // seconds (optional)
-	Enabled     bool   `json:"enabled"`
+// Redis list holding the most recent rule changes (newest first)
+const auditKey = "audit:rules"
+
+// Deny list read by the gatekeeper: sets deny:ip and deny:cidr. Sets have
+// no per-member TTL, so expiries live in a sorted set ("kind|entry" scored
+// by unix expiry) that reapDenyList prunes.
+const denyExpiryKey = "deny:expiry"
+
+var errCorruptRule = errors.New("corrupt rule JSON")
+
+// A create refused by MAX_RULES
+var errRuleCap = errors.New("rule limit reached")
+
+// How long a SCAN count backs MAX_RULES checks before it is redone
+const ruleCapTTL = 5 * time.Second
+
+const asnFormatMsg = `asn must be "*" or AS<number> (e.g. AS12345)`
+
+// Upper bound for tarpit_ms; longer holds just tie up gatekeeper slots
+const maxTarpitMs = 60000
+
+// Shared with the gatekeeper so both sides agree on the stored JSON
+type Rule = rules.Rule
+
+// Validation failure with a metrics-friendly reason
+type ruleError struct {
+	reason string
+	msg    string
+}
+
+func (e *ruleError) Error() string { return e.msg }
+
+// Rule as persisted, plus where it lives and how long it has left
+type StoredRule struct {
+	Rule
+	Key          string `json:"key"`
+	RemainingTTL int    `json:"remaining_ttl"` // seconds; -1 = no expiry
+}
+
+type AuditEntry struct {
+	Time      time.Time `json:"ts"`
+	Kind      string    `json:"kind"`   // rule, or deny for the IP/CIDR deny set
+	Action    string    `json:"action"` // rule: create | update | toggle | extend | delete; deny: add | remove
+	Key       string    `json:"key"`
+	Old       *Rule     `json:"old,omitempty"`
+	New       *Rule     `json:"new,omitempty"`
+	Origin    string    `json:"origin,omitempty"` // browser Origin, if any
+	Remote    string    `json:"remote,omitempty"` // client address (XFF-aware)
+	RequestID string    `json:"request_id,omitempty"`
 }
 
 var (
-	rdb            *redis.Client
+	rdb            redis.UniversalClient
 	ctx            = context.Background()
 	allowedOrigins []string
 	allowAny       bool
+
+	// Optional bearer token for mutating endpoints (empty = auth disabled)
+	apiToken     string
+	protectReads bool
+
+	auditMax    int64
+	auditStdout bool
+
+	webhookURL    string
+	webhookSecret string
+	webhookQueue  chan AuditEntry
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+	// MAX_RULES caps how many rule keys writes may create (0 = no cap).
+	// ruleCap holds the last count plus creates made since.
+	maxRules int
+	ruleCap  struct {
+		mu sync.Mutex
+		n  int
+		at time.Time
+	}
+
+	// Dry-run (/evaluate) inputs; must match the gatekeeper's settings
+	geoURL     string
+	geoClient  = &http.Client{Timeout: 5 * time.Second}
+	scheduleTZ = time.UTC
+
+	ruleChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_controller_rule_changes_total",
+			Help: "Successful rule mutations by action (create, update, toggle, extend, delete)",
+		},
+		[]string{"action"},
+	)
+	denyChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_controller_deny_changes_total",
+			Help: "Successful deny-set changes by action (add, remove)",
+		},
+		[]string{"action"},
+	)
+	ruleRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_controller_rule_rejections_total",
+			Help: "Rule requests rejected by validation, by reason",
+		},
+		[]string{"reason"},
+	)
+	ruleCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "alak_controller_rules",
+			Help: "Current number of rules in Redis (sampled periodically)",
+		},
+	)
+	streamClients = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "alak_controller_stream_clients",
+			Help: "Open GET /rules/stream connections",
+		},
+	)
 )
 
+func init() {
+	prometheus.MustRegister(ruleChanges)
+	prometheus.MustRegister(denyChanges)
+	prometheus.MustRegister(ruleRejections)
+	prometheus.MustRegister(ruleCount)
+	prometheus.MustRegister(streamClients)
+}
+
 func main() {
 	// ---- Redis ----
 	redisHost := os.Getenv("REDIS_HOST")
 	if redisHost == "" {
 		redisHost = "localhost:6379"
 	}
-	rdb = redis.NewClient(&redis.Options{Addr: redisHost})
+	// REDIS_MODE=single|sentinel|cluster; sentinel/cluster seed nodes come
+	// from REDIS_ADDRS (comma-separated), falling back to REDIS_HOST.
+	addrs := splitAndTrim(os.Getenv("REDIS_ADDRS"))
+	if len(addrs) == 0 {
+		addrs = []string{redisHost}
+	}
+	rdb = newRedisClient(os.Getenv("REDIS_MODE"), &redis.UniversalOptions{
+		Addrs:      addrs,
+		MasterName: os.Getenv("REDIS_MASTER_NAME"),
+	})
 
 	// ---- CORS allow-list from env ----
 	// CORS_ORIGINS="https://dash.example.com,http://localhost:3000"
@@ -47,12 +182,89 @@ func main() {
 	}
 	allowAny = len(allowedOrigins) == 1 && allowedOrigins[0] == "*"
 
+	// ---- Auth ----
+	// API_TOKEN="s3cret" requires "Authorization: Bearer s3cret" on writes.
+	// API_PROTECT_READS=true extends the check to GET (health/livez stay open).
+	apiToken = strings.TrimSpace(os.Getenv("API_TOKEN"))
+	protectReads = strings.EqualFold(os.Getenv("API_PROTECT_READS"), "true")
+	if apiToken == "" {
+		log.Printf("⚠️  API_TOKEN not set — rule mutations are unauthenticated.")
+	}
+
+	// ---- Audit trail ----
+	// AUDIT_MAX_ENTRIES caps the Redis list; AUDIT_STDOUT=true also logs each entry.
+	auditMax = 1000
+	if n, err := strconv.ParseInt(os.Getenv("AUDIT_MAX_ENTRIES"), 10, 64); err == nil && n > 0 {
+		auditMax = n
+	}
+	auditStdout = strings.EqualFold(os.Getenv("AUDIT_STDOUT"), "true")
+
+	// ---- Rule cap ----
+	// MAX_RULES=N refuses creates (POST/PUT to a new key) once N rules exist.
+	if v := strings.TrimSpace(os.Getenv("MAX_RULES")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid MAX_RULES %q (want a count >= 0)", v)
+		}
+		maxRules = n
+	}
+
+	// ---- Webhook ----
+	// WEBHOOK_URL receives a POST per rule change; WEBHOOK_SECRET signs the body.
+	webhookURL = strings.TrimSpace(os.Getenv("WEBHOOK_URL"))
+	webhookSecret = os.Getenv("WEBHOOK_SECRET")
+	if webhookURL != "" {
+		startWebhookWorkers(2, 256)
+	}
+
+	// ---- Dry-run ----
+	// ALAK_GEO_URL and ALAK_SCHEDULE_TZ mirror the gatekeeper's so /evaluate
+	// classifies clients the same way.
+	geoURL = os.Getenv("ALAK_GEO_URL")
+	if geoURL == "" {
+		geoURL = "http://alak-geo:8081/lookup"
+	}
+	if tz := os.Getenv("ALAK_SCHEDULE_TZ"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("invalid ALAK_SCHEDULE_TZ %q: %v", tz, err)
+		}
+		scheduleTZ = loc
+	}
+
+	// ---- Seed rules ----
+	// RULES_SEED_FILE is a JSON array of rules written at startup;
+	// RULES_SEED_MODE=if-absent (default) keeps live edits, overwrite resets them.
+	if path := strings.TrimSpace(os.Getenv("RULES_SEED_FILE")); path != "" {
+		mode := strings.ToLower(strings.TrimSpace(os.Getenv("RULES_SEED_MODE")))
+		if mode == "" {
+			mode = "if-absent"
+		}
+		if mode != "if-absent" && mode != "overwrite" {
+			log.Fatalf("invalid RULES_SEED_MODE %q (want if-absent or overwrite)", mode)
+		}
+		seedRules(path, mode)
+	}
+
+	go sampleRuleCount(30 * time.Second)
+	go reapDenyList(10 * time.Second)
+
 	// ---- Routes ----
 	http.HandleFunc("/health", corsMiddleware(healthHandler))
-	http.HandleFunc("/rules", corsMiddleware(rulesHandler))
-	http.HandleFunc("/tsp-list", corsMiddleware(tspListHandler))
+	http.HandleFunc("/livez", corsMiddleware(livezHandler))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/rules", corsMiddleware(authMiddleware(rulesHandler)))
+	http.HandleFunc("/rules/one", corsMiddleware(authMiddleware(ruleOneHandler)))
+	http.HandleFunc("/rules/stream", corsMiddleware(authMiddleware(ruleStreamHandler)))
+	http.HandleFunc("/rules/count", corsMiddleware(authMiddleware(countRulesHandler)))
+	http.HandleFunc("/rules/extend", corsMiddleware(authMiddleware(extendRuleHandler)))
+	http.HandleFunc("/deny", corsMiddleware(authMiddleware(denyHandler)))
+	http.HandleFunc("/tsp-list", corsMiddleware(authMiddleware(tspListHandler)))
+	http.HandleFunc("/tsp-stats", corsMiddleware(authMiddleware(tspStatsHandler)))
+	http.HandleFunc("/audit", corsMiddleware(authMiddleware(auditHandler)))
+	http.HandleFunc("/evaluate", corsMiddleware(authMiddleware(evaluateHandler)))
 	// Back-compat: some clients call /toggle-rule
-	http.HandleFunc("/toggle-rule", corsMiddleware(toggleRuleHandler))
+	http.HandleFunc("/toggle-rule", corsMiddleware(authMiddleware(toggleRuleHandler)))
 	// Safety net: catch stray preflights so they don’t 404 without CORS headers
 	http.HandleFunc("/", preflightFallback)
 
@@ -133,9 +345,132 @@ func preflightFallback(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+/* ------------------------------ Auth helpers ---------------------------- */
+
+// Runs after corsMiddleware, so preflights never reach it and 401s still
+// carry CORS headers the browser can read.
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiToken == "" || (!protectReads && !isMutating(r.Method)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validBearer(r.Header.Get("Authorization")) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="alak-controller"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPatch, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func validBearer(header string) bool {
+	const prefix = "Bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return false
+	}
+	got := strings.TrimSpace(header[len(prefix):])
+	return subtle.ConstantTimeCompare([]byte(got), []byte(apiToken)) == 1
+}
+
+/* ---------------------------- Webhook helpers --------------------------- */
+
+const webhookMaxAttempts = 5
+
+type webhookPayload struct {
+	Event string `json:"event"` // kind.action: rule.create, rule.update, …, deny.add, deny.remove
+	AuditEntry
+}
+
+func startWebhookWorkers(n, queueSize int) {
+	webhookQueue = make(chan AuditEntry, queueSize)
+	for i := 0; i < n; i++ {
+		go func() {
+			for entry := range webhookQueue {
+				deliverWebhook(entry)
+			}
+		}()
+	}
+}
+
+// Never blocks the request path: drops (and logs) when the queue is full
+func enqueueWebhook(entry AuditEntry) {
+	if webhookQueue == nil {
+		return
+	}
+	select {
+	case webhookQueue <- entry:
+	default:
+		log.Printf("[WARN] webhook queue full; dropping %s event for %s", entry.Action, entry.Key)
+	}
+}
+
+func deliverWebhook(entry AuditEntry) {
+	body, _ := json.Marshal(webhookPayload{Event: entry.Kind + "." + entry.Action, AuditEntry: entry})
+	backoff := 500 * time.Millisecond
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		status, err := postWebhook(body)
+		if err == nil && status < 500 {
+			if status >= 400 {
+				log.Printf("[WARN] webhook rejected %s event for %s: status %d", entry.Action, entry.Key, status)
+			}
+			return
+		}
+		if attempt == webhookMaxAttempts {
+			log.Printf("[WARN] webhook delivery failed for %s after %d attempts (status=%d err=%v)", entry.Key, attempt, status, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(webhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Alak-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
 /* ------------------------------- Handlers ------------------------------ */
 
+// Readiness: 503 unless Redis answers a PING within a second, since every
+// read and write needs it.
 func healthHandler(w http.ResponseWriter, r *http.Request) {
+	pingCtx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/json")
+	if err := rdb.Ping(pingCtx).Err(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "redis": err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "redis": "ok"})
+}
+
+// Liveness only: the process is up, whatever Redis does.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true})
 }
@@ -143,19 +478,34 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 func rulesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		keys, err := rdb.Keys(ctx, "rule:*").Result()
+		keys, err := ruleKeys()
 		if err != nil {
 			http.Error(w, "Redis keys error", http.StatusInternalServerError)
 			return
 		}
-		var rules []Rule
-		for _, key := range keys {
-			val, err := rdb.Get(ctx, key).Result()
-			if err == nil {
-				var rule Rule
-				if json.Unmarshal([]byte(val), &rule) == nil {
-					rules = append(rules, rule)
-				}
+		// One round trip for every GET+TTL instead of two per key
+		pipe := rdb.Pipeline()
+		gets := make([]*redis.StringCmd, len(keys))
+		ttls := make([]*redis.DurationCmd, len(keys))
+		for i, key := range keys {
+			gets[i] = pipe.Get(ctx, key)
+			ttls[i] = pipe.TTL(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			http.Error(w, "Redis read error", http.StatusInternalServerError)
+			return
+		}
+		// ?label=k=v (or just ?label=k); repeat to require several
+		labels := r.URL.Query()["label"]
+		var rules []StoredRule
+		for i, key := range keys {
+			val, err := gets[i].Result()
+			if err != nil {
+				continue // expired between SCAN and GET
+			}
+			var rule Rule
+			if json.Unmarshal([]byte(val), &rule) == nil && hasLabels(rule, labels) {
+				rules = append(rules, storedRule(key, rule, ttls[i].Val()))
 			}
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -163,182 +513,1629 @@ func rulesHandler(w http.ResponseWriter, r *http.Request) {
 
 	case http.MethodPost:
 		var rule Rule
-		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		ttl, _, rerr := decodeRuleWrite(r, &rule)
+		if rerr != nil {
+			rejectRule(w, rerr.reason, rerr.msg)
 			return
 		}
-		normalizeRule(&rule)
-		key := buildRuleKey(rule)
-		data, _ := json.Marshal(rule)
-		ttl := time.Duration(rule.TTL) * time.Second
-		if err := rdb.Set(ctx, key, data, ttl).Err(); err != nil {
+		key := rules.Key(rule)
+
+		// Upsert: 201 only when the key didn't exist. The existence check
+		// and the write share a WATCH so the status can't lie under a race.
+		var (
+			old      *Rule
+			reserved bool
+		)
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			old, _ = loadRule(tx, key)
+			if old == nil {
+				if err := reserveRuleSlot(); err != nil {
+					return err
+				}
+				reserved = true
+			}
+			stamp(&rule, old)
+			data, _ := json.Marshal(rule)
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, ttl)
+				return nil
+			})
+			return err
+		}, key)
+		if err != nil && reserved {
+			releaseRuleSlot()
+		}
+		if errors.Is(err, errRuleCap) {
+			rejectRuleCap(w)
+			return
+		}
+		if errors.Is(err, redis.TxFailedErr) {
+			http.Error(w, "Rule was modified concurrently, retry", http.StatusConflict)
+			return
+		}
+		if err != nil {
 			http.Error(w, "Redis write error", http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		_, _ = w.Write([]byte(`{"ok":true,"msg":"Rule stored"}`))
+		if old != nil {
+			recordChange(r, "update", key, old, &rule)
+			writeStored(w, http.StatusOK, "Rule updated", storedRule(key, rule, ttl))
+			return
+		}
+		recordChange(r, "create", key, nil, &rule)
+		writeStored(w, http.StatusCreated, "Rule stored", storedRule(key, rule, ttl))
 
 	case http.MethodDelete:
-		asn := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("asn")))
-		country := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("country")))
-		tsp := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tsp")))
-		if asn == "" || country == "" || tsp == "" {
-			http.Error(w, "asn, country, tsp required", http.StatusBadRequest)
+		q := r.URL.Query()
+		target := Rule{ASN: q.Get("asn"), Country: q.Get("country"), TSP: q.Get("tsp"), City: q.Get("city"), UAClass: q.Get("ua_class")}
+		normalizeRule(&target)
+		if err := validateTarget(target); err != nil {
+			rejectRule(w, err.reason, err.msg)
 			return
 		}
-		key := "rule:" + asn + ":" + country + ":" + tsp
+		key := targetKey(target, q.Get("tsp"))
+		old, _ := loadRule(rdb, key)
 		if err := rdb.Del(ctx, key).Err(); err != nil {
 			http.Error(w, "Redis delete error", http.StatusInternalServerError)
 			return
 		}
+		if old != nil {
+			releaseRuleSlot()
+			recordChange(r, "delete", key, old, nil)
+		}
 		w.Header().Set("Content-Type", "application/json")
 		_, _ = w.Write([]byte(`{"ok":true,"msg":"Rule deleted"}`))
 
-	case http.MethodPatch, http.MethodPut:
+	case http.MethodPatch:
+		patchRule(w, r)
+
+	case http.MethodPut:
 		var rule Rule
-		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		ttl, exact, rerr := decodeRuleWrite(r, &rule)
+		if rerr != nil {
+			rejectRule(w, rerr.reason, rerr.msg)
 			return
 		}
-		normalizeRule(&rule)
-		key := buildRuleKey(rule)
+		key := rules.Key(rule)
 
-		// Preserve existing TTL on updates/toggles
-		expiry := preserveOrNewTTL(key, time.Duration(rule.TTL)*time.Second)
-
-		data, _ := json.Marshal(rule)
-		if err := rdb.Set(ctx, key, data, expiry).Err(); err != nil {
+		// Read-modify-write under WATCH so a concurrent edit yields 409
+		// instead of being silently overwritten.
+		var (
+			old      *Rule
+			expiry   time.Duration
+			reserved bool
+		)
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			// Preserve existing TTL on updates/toggles, and the stored ttl
+			// field with it so the two keep agreeing
+			expiry = preserveOrNewTTL(tx, key, ttl)
+			old, _ = loadRule(tx, key)
+			if old == nil {
+				if err := reserveRuleSlot(); err != nil {
+					return err
+				}
+				reserved = true
+			} else if exact {
+				return errExpiresAtOnUpdate
+			} else {
+				rule.TTL = old.TTL
+			}
+			stamp(&rule, old)
+			data, _ := json.Marshal(rule)
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, expiry)
+				return nil
+			})
+			return err
+		}, key)
+		if err != nil && reserved {
+			releaseRuleSlot()
+		}
+		if errors.Is(err, errRuleCap) {
+			rejectRuleCap(w)
+			return
+		}
+		if errors.Is(err, errExpiresAtOnUpdate) {
+			rejectRule(w, "invalid_expires_at", "expires_at only applies when PUT creates the rule; use POST /rules/extend to change an existing rule's expiry")
+			return
+		}
+		if errors.Is(err, redis.TxFailedErr) {
+			http.Error(w, "Rule was modified concurrently, retry", http.StatusConflict)
+			return
+		}
+		if err != nil {
 			http.Error(w, "Redis write error", http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte(`{"ok":true,"msg":"Rule updated"}`))
+		recordChange(r, "update", key, old, &rule)
+		writeStored(w, http.StatusOK, "Rule updated", storedRule(key, rule, expiry))
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-// Accept POST/PATCH/PUT for back-compat; toggles only `enabled`
-func toggleRuleHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
+// PUT with expires_at on a rule that already exists: PUT keeps an existing
+// key's expiry, so the timestamp would be silently dropped
+var errExpiresAtOnUpdate = errors.New("expires_at on an existing rule")
+
+// Decodes, normalizes and validates a POST/PUT /rules body. The returned
+// expiry comes from ttl, or from expires_at when given (exact=true), which
+// wins over ttl and is exact to the millisecond (rule.TTL then echoes it in
+// seconds).
+func decodeRuleWrite(r *http.Request, rule *Rule) (ttl time.Duration, exact bool, rerr *ruleError) {
+	body, err := io.ReadAll(r.Body)
+	var in struct {
+		ExpiresAt json.RawMessage `json:"expires_at"`
+	}
+	if err != nil || json.Unmarshal(body, rule) != nil || json.Unmarshal(body, &in) != nil {
+		return 0, false, &ruleError{"invalid_json", "Invalid JSON"}
+	}
+	normalizeRule(rule)
+	if err := validateRule(*rule); err != nil {
+		return 0, false, err
+	}
+	ttl = time.Duration(rule.TTL) * time.Second
+	if d, ok, err := parseExpiresAt(in.ExpiresAt, time.Now()); err != nil {
+		return 0, false, err
+	} else if ok {
+		ttl, exact = d, true
+		rule.TTL = ttlSeconds(d)
+	}
+	return ttl, exact, nil
+}
+
+// A positive expiry as the rule's ttl field: whole seconds, rounded, but
+// never 0 (which would read as permanent)
+func ttlSeconds(d time.Duration) int {
+	return max(int(d.Round(time.Second)/time.Second), 1)
+}
+
+// expires_at as the time left from now: an RFC3339 string or Unix seconds
+// (number or numeric string). ok=false when absent or null.
+func parseExpiresAt(raw json.RawMessage, now time.Time) (d time.Duration, ok bool, rerr *ruleError) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, false, nil
+	}
+	bad := &ruleError{"invalid_expires_at", "expires_at must be an RFC3339 time or Unix seconds"}
+	var v any
+	if json.Unmarshal(raw, &v) != nil {
+		return 0, false, bad
+	}
+	var at time.Time
+	switch v := v.(type) {
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, false, bad
+		}
+		at = time.Unix(int64(v), 0)
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			at = time.Unix(n, 0)
+		} else if at, err = time.Parse(time.RFC3339, v); err != nil {
+			return 0, false, bad
+		}
+	default:
+		return 0, false, bad
+	}
+	if d = at.Sub(now); d <= 0 {
+		return 0, false, &ruleError{"invalid_expires_at", fmt.Sprintf("expires_at %s is in the past", at.UTC().Format(time.RFC3339Nano))}
+	}
+	return d, true, nil
+}
+
+// PATCH /rules: partial update of an existing rule. asn/country/tsp[/city][/ua_class]
+// pick the rule; every other field present in the body replaces the stored
+// one (null clears optional fields), everything absent is kept, and so is
+// the key's expiry. Decoding the body onto the stored rule gives exactly
+// those semantics without a pointer-per-field mirror of Rule. The expiry
+// is the exception, as on PUT: ttl stays the stored one (a body may echo
+// it, not change it) and expires_at is refused; POST /rules/extend moves it.
+func patchRule(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rejectRule(w, "invalid_json", "Invalid JSON")
 		return
 	}
-	if r.Method != http.MethodPost && r.Method != http.MethodPatch && r.Method != http.MethodPut {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	var (
+		target Rule
+		fields map[string]json.RawMessage
+	)
+	if json.Unmarshal(body, &target) != nil || json.Unmarshal(body, &fields) != nil {
+		rejectRule(w, "invalid_json", "Invalid JSON")
 		return
 	}
-
-	type payload struct {
-		ASN     string `json:"asn"`
-		Country string `json:"country"`
-		TSP     string `json:"tsp"`
-		Enabled *bool  `json:"enabled"` // nil => invert
+	normalizeRule(&target)
+	if err := validateTarget(target); err != nil {
+		rejectRule(w, err.reason, err.msg)
+		return
 	}
-	var p payload
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if raw, ok := fields["expires_at"]; ok && string(raw) != "null" {
+		rejectRule(w, "invalid_expires_at", "PATCH keeps the rule's expiry; use POST /rules/extend to change it")
 		return
 	}
+	key := rules.Key(target)
 
-	// Normalize identifiers
-	p.ASN = strings.ToUpper(strings.TrimSpace(p.ASN))
-	p.Country = strings.ToUpper(strings.TrimSpace(p.Country))
-	p.TSP = strings.ToLower(strings.TrimSpace(p.TSP))
-	if p.ASN == "" || p.Country == "" || p.TSP == "" {
-		http.Error(w, "asn, country, tsp required", http.StatusBadRequest)
+	var (
+		old, cur Rule
+		expiry   time.Duration
+		invalid  *ruleError
+	)
+	err = rdb.Watch(ctx, func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(val), &old); err != nil {
+			return errCorruptRule
+		}
+		cur = old
+		if _, ok := fields["labels"]; ok {
+			// Replaced as a whole: decoding into the shared map would merge
+			// into it, and into old with it
+			cur.Labels = nil
+		}
+		_ = json.Unmarshal(body, &cur) // already decoded once above
+		if cur.TTL != old.TTL {
+			invalid = &ruleError{"invalid_ttl", fmt.Sprintf("PATCH keeps the rule's ttl (%d); use POST /rules/extend to change it", old.TTL)}
+			return invalid
+		}
+		normalizeRule(&cur)
+		stamp(&cur, &old)
+		if invalid = validateRule(cur); invalid != nil {
+			return invalid
+		}
+		expiry = preserveOrNewTTL(tx, key, 0)
+		data, _ := json.Marshal(cur)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, expiry)
+			return nil
+		})
+		return err
+	}, key)
+	switch {
+	case invalid != nil:
+		rejectRule(w, invalid.reason, invalid.msg)
+		return
+	case err == redis.Nil:
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errCorruptRule):
+		http.Error(w, "Corrupt rule JSON", http.StatusInternalServerError)
+		return
+	case errors.Is(err, redis.TxFailedErr):
+		http.Error(w, "Rule was modified concurrently, retry", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Redis write error", http.StatusInternalServerError)
 		return
 	}
+	recordChange(r, "update", key, &old, &cur)
+	writeStored(w, http.StatusOK, "Rule updated", storedRule(key, cur, expiry))
+}
 
-	key := "rule:" + p.ASN + ":" + p.Country + ":" + p.TSP
+// GET /rules/one?asn=&country=&tsp=[&city=][&ua_class=] — a single rule with its remaining TTL
+func ruleOneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	rule := Rule{ASN: q.Get("asn"), Country: q.Get("country"), TSP: q.Get("tsp"), City: q.Get("city"), UAClass: q.Get("ua_class")}
+	normalizeRule(&rule)
+	if err := validateTarget(rule); err != nil {
+		rejectRule(w, err.reason, err.msg)
+		return
+	}
+	key := targetKey(rule, q.Get("tsp"))
 
-	// Load existing rule
-	val, err := rdb.Get(ctx, key).Result()
+	cur, err := loadRule(rdb, key)
 	if err != nil {
+		http.Error(w, "Redis read error", http.StatusInternalServerError)
+		return
+	}
+	if cur == nil {
 		http.Error(w, "Rule not found", http.StatusNotFound)
 		return
 	}
-	var cur Rule
-	if err := json.Unmarshal([]byte(val), &cur); err != nil {
-		http.Error(w, "Corrupt rule JSON", http.StatusInternalServerError)
+	ttl, err := rdb.TTL(ctx, key).Result()
+	if err != nil {
+		http.Error(w, "Redis read error", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(storedRule(key, *cur, ttl))
+}
 
-	// Toggle or set explicitly
-	if p.Enabled != nil {
-		cur.Enabled = *p.Enabled
-	} else {
-		cur.Enabled = !cur.Enabled
+// GET /rules/count?asn=&country=&tsp=&city=: how many rules a pattern
+// covers, from key names alone. Omitted fields match any value; a given
+// "*" matches only the literal wildcard segment. Naming no field at all
+// requires ?all=true, so "every rule" is never the result of a typo.
+func countRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-
-	// Preserve current TTL (or use no-expire if none)
-	expiry := preserveOrNewTTL(key, 0)
-
-	data, _ := json.Marshal(cur)
-	if err := rdb.Set(ctx, key, data, expiry).Err(); err != nil {
-		http.Error(w, "Redis write error", http.StatusInternalServerError)
+	q := r.URL.Query()
+	want := Rule{ASN: q.Get("asn"), Country: q.Get("country"), TSP: q.Get("tsp"), City: q.Get("city"), UAClass: q.Get("ua_class")}
+	normalizeRule(&want)
+	if err := validateIDs(want); err != nil {
+		rejectRule(w, err.reason, err.msg)
+		return
+	}
+	if want.ASN+want.Country+want.TSP+want.City+want.UAClass == "" && q.Get("all") != "true" {
+		rejectRule(w, "missing_fields", "give at least one of asn, country, tsp, city, ua_class (or all=true to count every rule)")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"ok":      true,
-		"msg":     "Rule toggled",
-		"enabled": cur.Enabled,
-	})
-}
-
-/* ------------------------------- Helpers ------------------------------- */
+	// SCAN pattern is a superset (its "*" also matches literal wildcards,
+	// 4-part keys without a city and ua= keys without a ua_class); ParseKey
+	// below does the exact match
+	glob := Rule{ASN: "*", Country: "*", TSP: "*", City: want.City, UAClass: want.UAClass}
+	if want.ASN != "" {
+		glob.ASN = want.ASN
+	}
+	if want.Country != "" {
+		glob.Country = want.Country
+	}
+	if want.TSP != "" {
+		glob.TSP = want.TSP
+	}
+	pattern := globEscaper.Replace(rules.Key(glob))
+	if !strings.HasSuffix(pattern, "*") {
+		pattern += "*"
+	}
 
-func preserveOrNewTTL(key string, ifNew time.Duration) time.Duration {
-	ttl, err := rdb.TTL(ctx, key).Result()
+	var (
+		mu   sync.Mutex
+		seen = map[string]bool{} // SCAN may return a key more than once
+	)
+	err := forEachNode(func(node redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, pattern, 500).Result()
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			for _, k := range keys {
+				m, ok := rules.ParseKey(k)
+				if ok && (want.ASN == "" || m.ASN == want.ASN) && (want.Country == "" || m.Country == want.Country) &&
+					(want.TSP == "" || m.TSP == want.TSP) && (want.City == "" || m.City == want.City) &&
+					(want.UAClass == "" || m.UAClass == want.UAClass) {
+					seen[k] = true
+				}
+			}
+			mu.Unlock()
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
 	if err != nil {
-		return ifNew
-	}
-	switch {
-	case ttl == -2: // key not found
-		return ifNew
-	case ttl == -1: // no expire set
-		return 0
-	default:
-		return ttl // keep existing
+		http.Error(w, "Redis scan error", http.StatusInternalServerError)
+		return
 	}
+	writeJSON(w, map[string]any{"pattern": pattern, "count": len(seen)})
 }
 
-func normalizeRule(rule *Rule) {
-	rule.Country = strings.ToUpper(strings.TrimSpace(rule.Country))
-	rule.City = strings.ToLower(strings.TrimSpace(rule.City))
-	rule.TSP = strings.ToLower(strings.TrimSpace(rule.TSP))
-	rule.ASN = strings.ToUpper(strings.TrimSpace(rule.ASN))
+// One server-sent event per rule key change, from Redis keyspace
+// notifications (so writes made outside the controller show up too).
+type RuleEvent struct {
+	Op  string `json:"op"` // Redis event: set, del, expire, expired, ...
+	Key string `json:"key"`
+	rules.Meta
+	Time int64 `json:"time"`
 }
 
-func buildRuleKey(rule Rule) string {
-	return "rule:" + rule.ASN + ":" + rule.Country + ":" + rule.TSP
-}
+// GET /rules/stream: SSE feed of rule changes for dashboards, replacing
+// polling of GET /rules. Needs notify-keyspace-events with K plus $, g and
+// x (or A); without them it answers 503 so clients fall back to polling.
+func ruleStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	on, err := keyspaceEventsOn()
+	if err != nil {
+		// Managed Redis often disables CONFIG; subscribe anyway
+		log.Printf("[WARN] /rules/stream: can't read notify-keyspace-events (%v); events arrive only if it includes K$gx", err)
+	} else if !on {
+		log.Printf("[WARN] /rules/stream: Redis keyspace notifications are off; enable with: CONFIG SET notify-keyspace-events K$gx")
+		http.Error(w, "Rule stream unavailable: Redis keyspace notifications disabled; poll GET /rules", http.StatusServiceUnavailable)
+		return
+	}
 
-func tspListHandler(w http.ResponseWriter, r *http.Request) {
-	keys, err := rdb.Keys(ctx, "rule:*").Result()
+	subs, err := subscribeEachNode(r.Context(), "__keyspace@*__:rule:*")
+	defer func() {
+		for _, ps := range subs {
+			_ = ps.Close()
+		}
+	}()
 	if err != nil {
-		http.Error(w, "Redis error", http.StatusInternalServerError)
+		http.Error(w, "Redis subscribe error", http.StatusInternalServerError)
 		return
 	}
-	tspSet := make(map[string]struct{})
-	for _, key := range keys {
-		parts := strings.Split(key, ":")
-		if len(parts) >= 4 {
-			tsp := parts[3]
-			if tsp != "" {
-				tspSet[tsp] = struct{}{}
+	msgs := make(chan *redis.Message)
+	for _, ps := range subs {
+		go func(ch <-chan *redis.Message) {
+			for m := range ch {
+				select {
+				case msgs <- m:
+				case <-r.Context().Done():
+					return
+				}
 			}
-		}
+		}(ps.Channel())
 	}
-	var tsps []string
-	for tsp := range tspSet {
-		tsps = append(tsps, tsp)
+
+	streamClients.Inc()
+	defer streamClients.Dec()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx: don't buffer the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	// Comment lines keep idle proxies from closing the connection
+	ping := time.NewTicker(25 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case m := <-msgs:
+			_, key, _ := strings.Cut(m.Channel, "__:")
+			ev := RuleEvent{Op: m.Payload, Key: key, Time: time.Now().Unix()}
+			ev.Meta, _ = rules.ParseKey(key)
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Op, data)
+		}
+		flusher.Flush()
 	}
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(tsps)
+}
+
+// Reports whether every node publishes the keyspace events the rule stream
+// uses. "A" is shorthand for all event classes.
+func keyspaceEventsOn() (bool, error) {
+	var (
+		mu sync.Mutex
+		on = true
+	)
+	err := forEachNode(func(node redis.Cmdable) error {
+		v, err := node.ConfigGet(ctx, "notify-keyspace-events").Result()
+		if err != nil {
+			return err
+		}
+		flags := ""
+		if len(v) == 2 {
+			flags, _ = v[1].(string)
+		}
+		if !strings.Contains(flags, "K") ||
+			!(strings.Contains(flags, "A") || strings.Contains(flags, "$") && strings.Contains(flags, "g") && strings.Contains(flags, "x")) {
+			mu.Lock()
+			on = false
+			mu.Unlock()
+		}
+		return nil
+	})
+	return on, err
+}
+
+// Keyspace notifications are published on the node holding the key, so
+// in cluster mode every master needs its own subscription.
+func subscribeEachNode(c context.Context, pattern string) ([]*redis.PubSub, error) {
+	var (
+		mu   sync.Mutex
+		subs []*redis.PubSub
+	)
+	subscribe := func(client redis.UniversalClient) error {
+		ps := client.PSubscribe(c, pattern)
+		mu.Lock()
+		subs = append(subs, ps)
+		mu.Unlock()
+		_, err := ps.Receive(c) // subscription confirmation, or the error
+		return err
+	}
+	if cc, ok := rdb.(*redis.ClusterClient); ok {
+		err := cc.ForEachMaster(c, func(_ context.Context, n *redis.Client) error {
+			return subscribe(n)
+		})
+		return subs, err
+	}
+	return subs, subscribe(rdb)
+}
+
+type DenyEntry struct {
+	Entry        string `json:"entry"`
+	Kind         string `json:"kind"`          // ip or cidr
+	RemainingTTL int    `json:"remaining_ttl"` // seconds, -1 = permanent
+}
+
+// Canonical form and kind of a deny entry: "ip" for an address, "cidr"
+// for a prefix (host bits cleared, so 203.0.113.5/24 is 203.0.113.0/24).
+func parseDenyEntry(s string) (entry, kind string, ok bool) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String(), "ip", true
+	}
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n.String(), "cidr", true
+	}
+	return "", "", false
+}
+
+// GET /deny lists the deny sets, POST /deny {"entry","ttl"} adds to them
+// (201 new, 200 already listed; ttl 0 or absent = permanent), DELETE
+// /deny?entry= removes. Audited like rule changes.
+func denyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		pipe := rdb.Pipeline()
+		ips := pipe.SMembers(ctx, "deny:ip")
+		cidrs := pipe.SMembers(ctx, "deny:cidr")
+		exp := pipe.ZRangeWithScores(ctx, denyExpiryKey, 0, -1)
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			http.Error(w, "Redis read error", http.StatusInternalServerError)
+			return
+		}
+		expires := map[string]float64{}
+		for _, z := range exp.Val() {
+			expires[fmt.Sprint(z.Member)] = z.Score
+		}
+		now := float64(time.Now().Unix())
+		out := []DenyEntry{}
+		for kind, members := range map[string][]string{"ip": ips.Val(), "cidr": cidrs.Val()} {
+			for _, m := range members {
+				e := DenyEntry{Entry: m, Kind: kind, RemainingTTL: -1}
+				if at, ok := expires[kind+"|"+m]; ok {
+					e.RemainingTTL = max(int(at-now), 0)
+				}
+				out = append(out, e)
+			}
+		}
+		slices.SortFunc(out, func(a, b DenyEntry) int { return strings.Compare(a.Kind+a.Entry, b.Kind+b.Entry) })
+		writeJSON(w, out)
+
+	case http.MethodPost:
+		var p struct {
+			Entry string `json:"entry"`
+			TTL   int    `json:"ttl"` // seconds; 0 = permanent
+		}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			rejectRule(w, "invalid_json", "Invalid JSON")
+			return
+		}
+		entry, kind, ok := parseDenyEntry(p.Entry)
+		if !ok {
+			rejectRule(w, "invalid_deny_entry", fmt.Sprintf("entry must be an IP or CIDR, got %q", p.Entry))
+			return
+		}
+		if p.TTL < 0 {
+			rejectRule(w, "invalid_ttl", "ttl must be >= 0")
+			return
+		}
+		// Plain pipeline, not MULTI: the keys may sit on different cluster slots
+		pipe := rdb.Pipeline()
+		added := pipe.SAdd(ctx, "deny:"+kind, entry)
+		if p.TTL > 0 {
+			pipe.ZAdd(ctx, denyExpiryKey, &redis.Z{Score: float64(time.Now().Unix() + int64(p.TTL)), Member: kind + "|" + entry})
+		} else {
+			pipe.ZRem(ctx, denyExpiryKey, kind+"|"+entry)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			http.Error(w, "Redis write error", http.StatusInternalServerError)
+			return
+		}
+		recordDenyChange(r, "add", "deny:"+kind+":"+entry)
+		status, remaining := http.StatusOK, -1
+		if added.Val() > 0 {
+			status = http.StatusCreated
+		}
+		if p.TTL > 0 {
+			remaining = p.TTL
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "entry": DenyEntry{Entry: entry, Kind: kind, RemainingTTL: remaining}})
+
+	case http.MethodDelete:
+		entry, kind, ok := parseDenyEntry(r.URL.Query().Get("entry"))
+		if !ok {
+			rejectRule(w, "invalid_deny_entry", fmt.Sprintf("entry must be an IP or CIDR, got %q", r.URL.Query().Get("entry")))
+			return
+		}
+		pipe := rdb.Pipeline()
+		removed := pipe.SRem(ctx, "deny:"+kind, entry)
+		pipe.ZRem(ctx, denyExpiryKey, kind+"|"+entry)
+		if _, err := pipe.Exec(ctx); err != nil {
+			http.Error(w, "Redis delete error", http.StatusInternalServerError)
+			return
+		}
+		if removed.Val() == 0 {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		recordDenyChange(r, "remove", "deny:"+kind+":"+entry)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true,"msg":"Entry removed"}`))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Removes deny entries whose TTL has passed. Expiry is therefore only as
+// punctual as this loop (and needs a running controller).
+func reapDenyList(every time.Duration) {
+	for {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		due, err := rdb.ZRangeByScore(ctx, denyExpiryKey, &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+		if err != nil {
+			log.Printf("[WARN] deny list expiry scan failed: %v", err)
+		}
+		for _, m := range due {
+			// Claim the expiry first: a POST that made the entry permanent
+			// in the meantime has already removed it, and wins
+			kind, entry, _ := strings.Cut(m, "|")
+			if n, err := rdb.ZRem(ctx, denyExpiryKey, m).Result(); err != nil || n == 0 {
+				continue
+			}
+			if err := rdb.SRem(ctx, "deny:"+kind, entry).Err(); err != nil {
+				log.Printf("[WARN] expiring deny entry %s: %v", m, err)
+				continue
+			}
+			log.Printf("Deny entry %s %s expired", kind, entry)
+		}
+		time.Sleep(every)
+	}
+}
+
+// Glob metacharacters other than "*", which countRulesHandler uses on purpose
+var globEscaper = strings.NewReplacer(`\`, `\\`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// POST /rules/extend: reset an existing rule's expiry without rewriting it.
+// ttl > 0 → EXPIRE, ttl == 0 → PERSIST (never expires).
+func extendRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var p struct {
+		ASN     string `json:"asn"`
+		Country string `json:"country"`
+		TSP     string `json:"tsp"`
+		City    string `json:"city"`
+		UAClass string `json:"ua_class"`
+		TTL     *int   `json:"ttl"` // seconds; 0 = permanent
+
+		ExpiresAt json.RawMessage `json:"expires_at"` // wins over ttl
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		rejectRule(w, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	target := Rule{ASN: p.ASN, Country: p.Country, TSP: p.TSP, City: p.City, UAClass: p.UAClass}
+	normalizeRule(&target)
+	d, hasExpiry, rerr := parseExpiresAt(p.ExpiresAt, time.Now())
+	if target.ASN == "" || target.Country == "" || target.TSP == "" || (p.TTL == nil && !hasExpiry && rerr == nil) {
+		rejectRule(w, "missing_fields", "asn, country, tsp and ttl or expires_at required")
+		return
+	}
+	if err := validateTarget(target); err != nil {
+		rejectRule(w, err.reason, err.msg)
+		return
+	}
+	if rerr != nil {
+		rejectRule(w, rerr.reason, rerr.msg)
+		return
+	}
+	if hasExpiry {
+		secs := ttlSeconds(d)
+		p.TTL = &secs
+	} else if *p.TTL < 0 {
+		rejectRule(w, "invalid_ttl", "ttl must be >= 0")
+		return
+	}
+	key := rules.Key(target)
+
+	cur, err := loadRule(rdb, key)
+	if err != nil {
+		http.Error(w, "Redis read error", http.StatusInternalServerError)
+		return
+	}
+	if cur == nil {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+
+	ttl := time.Duration(*p.TTL) * time.Second
+	if hasExpiry {
+		ttl = d
+	}
+	var found bool
+	if ttl > 0 {
+		found, err = rdb.PExpire(ctx, key, ttl).Result()
+	} else {
+		// PERSIST is false for keys without an expiry too, so only a
+		// failed EXISTS means the rule vanished meanwhile
+		_, err = rdb.Persist(ctx, key).Result()
+		if err == nil {
+			var n int64
+			n, err = rdb.Exists(ctx, key).Result()
+			found = n == 1
+		}
+	}
+	if err != nil {
+		http.Error(w, "Redis write error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+
+	extended := *cur
+	extended.TTL = *p.TTL
+	recordChange(r, "extend", key, cur, &extended)
+	writeStored(w, http.StatusOK, "Rule extended", storedRule(key, extended, ttl))
+}
+
+// Accept POST/PATCH/PUT for back-compat; toggles only `enabled`
+func toggleRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type payload struct {
+		ASN     string `json:"asn"`
+		Country string `json:"country"`
+		TSP     string `json:"tsp"`
+		City    string `json:"city"`
+		UAClass string `json:"ua_class"`
+		Enabled *bool  `json:"enabled"` // nil => invert
+	}
+	var p payload
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		rejectRule(w, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	// Normalize identifiers
+	target := Rule{ASN: p.ASN, Country: p.Country, TSP: p.TSP, City: p.City, UAClass: p.UAClass}
+	normalizeRule(&target)
+	if err := validateTarget(target); err != nil {
+		rejectRule(w, err.reason, err.msg)
+		return
+	}
+
+	key := targetKey(target, p.TSP)
+
+	// Load, flip and write back under WATCH; a concurrent edit yields 409
+	var cur, prev Rule
+	err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+		val, err := tx.Get(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(val), &cur); err != nil {
+			return errCorruptRule
+		}
+		prev = cur
+
+		// Toggle or set explicitly
+		if p.Enabled != nil {
+			cur.Enabled = *p.Enabled
+		} else {
+			cur.Enabled = !cur.Enabled
+		}
+		stamp(&cur, &prev)
+
+		// Preserve current TTL (or use no-expire if none)
+		expiry := preserveOrNewTTL(tx, key, 0)
+
+		data, _ := json.Marshal(cur)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, expiry)
+			return nil
+		})
+		return err
+	}, key)
+	switch {
+	case err == redis.Nil:
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errCorruptRule):
+		http.Error(w, "Corrupt rule JSON", http.StatusInternalServerError)
+		return
+	case errors.Is(err, redis.TxFailedErr):
+		http.Error(w, "Rule was modified concurrently, retry", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Redis write error", http.StatusInternalServerError)
+		return
+	}
+	recordChange(r, "toggle", key, &prev, &cur)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":      true,
+		"msg":     "Rule toggled",
+		"enabled": cur.Enabled,
+	})
+}
+
+// GET /audit?limit=N — most recent rule and deny-set changes, newest first
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := int64(100)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > auditMax {
+		limit = auditMax
+	}
+	vals, err := rdb.LRange(ctx, auditKey, 0, limit-1).Result()
+	if err != nil {
+		http.Error(w, "Redis read error", http.StatusInternalServerError)
+		return
+	}
+	entries := make([]AuditEntry, 0, len(vals))
+	for _, v := range vals {
+		var e AuditEntry
+		if json.Unmarshal([]byte(v), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+// Dry-run verdict for one client. Decision is what the gatekeeper would do:
+// pass, drop, redirect, or random (dropped with drop_chance% probability).
+type evaluation struct {
+	IP             string      `json:"ip"`
+	At             time.Time   `json:"at"`
+	Meta           *rules.Meta `json:"meta,omitempty"`
+	KeysChecked    []string    `json:"keys_checked,omitempty"`
+	MatchedKey     string      `json:"matched_key,omitempty"`
+	Rule           *rules.Rule `json:"rule,omitempty"`
+	CombinedKeys   []string    `json:"combined_keys,omitempty"`  // broader rules folded in via combine
+	DropPercent    int         `json:"drop_percent"`             // effective, after combine
+	DropPerMille   *int        `json:"drop_per_mille,omitempty"` // effective, when the chain uses per-mille
+	Hash           int         `json:"hash"`                     // sticky-mode bucket, 0–99
+	HashPerMille   int         `json:"hash_per_mille"`           // sticky bucket for per-mille rules, 0–999
+	Decision       string      `json:"decision"`
+	Reason         string      `json:"reason"` // no_geo_data | no_rule | disabled | off_schedule | shadow | sticky | random
+	DropChance     float64     `json:"drop_chance"`
+	ShadowDecision string      `json:"shadow_decision,omitempty"` // what a shadow rule would have done
+}
+
+// GET /evaluate?ip=...[&at=RFC3339][&ua=User-Agent] — "would this client be
+// blocked?", resolved with the gatekeeper's own geo lookup and matching
+// code. Give ua to match as a gatekeeper running with UA_RULES would.
+func evaluateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	ip := strings.TrimSpace(q.Get("ip"))
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "ip must be a valid IP address", http.StatusBadRequest)
+		return
+	}
+	at := time.Now()
+	if v := q.Get("at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "at must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+		at = t
+	}
+
+	res := evaluation{IP: ip, At: at.UTC(), Hash: rules.HashIP(ip), HashPerMille: rules.HashIPPerMille(ip), Decision: "pass"}
+	meta, err := lookupGeo(r.Context(), ip)
+	if err != nil {
+		log.Printf("[WARN] evaluate: geo lookup for %s failed: %v", ip, err)
+		http.Error(w, "Geo lookup failed", http.StatusBadGateway)
+		return
+	}
+	if meta == nil {
+		res.Reason = "no_geo_data"
+		writeJSON(w, res)
+		return
+	}
+	if q.Has("ua") {
+		meta.UAClass = rules.ClassifyUA(q.Get("ua"))
+	}
+	res.Meta = meta
+	res.KeysChecked = rules.LookupKeys(*meta)
+
+	m, err := rules.Resolve(res.KeysChecked, at, scheduleTZ, func(key string) (string, bool, error) {
+		val, err := rdb.Get(r.Context(), key).Result()
+		if err == redis.Nil {
+			return "", false, nil
+		}
+		return val, err == nil, err
+	})
+	if errors.Is(err, rules.ErrCorruptRule) {
+		http.Error(w, "Corrupt rule JSON", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		http.Error(w, "Redis read error", http.StatusInternalServerError)
+		return
+	}
+	if m == nil {
+		res.Reason = "no_rule"
+		writeJSON(w, res)
+		return
+	}
+	match := &m.Rule
+	res.MatchedKey, res.Rule, res.CombinedKeys = m.Key, match, m.Combined
+	res.DropPercent, res.DropPerMille = m.DropPercent, m.DropPerMille
+	// The stored rule with the combined rate, as the gatekeeper enforces it
+	eff := m.Rule
+	eff.DropPercent, eff.DropPerMille = m.DropPercent, m.DropPerMille
+
+	// Same order of checks as the gatekeeper's proxyHandler
+	switch {
+	case !match.Enabled:
+		res.Reason = "disabled"
+	case !match.ActiveAt(at, scheduleTZ):
+		res.Reason = "off_schedule"
+	default:
+		decision, reason, chance := "pass", "sticky", 0.0
+		switch {
+		case match.DropMode == "random":
+			decision, reason, chance = "random", "random", eff.DropRate()
+		case eff.ShouldDrop(ip):
+			decision, chance = "drop", 100
+		}
+		if decision == "drop" && match.RedirectURL != "" {
+			decision = "redirect"
+		}
+		if match.Shadow {
+			res.Reason, res.ShadowDecision = "shadow", decision
+			if decision == "redirect" {
+				res.ShadowDecision = "drop" // shadow rules never redirect
+			}
+			break
+		}
+		res.Decision, res.Reason, res.DropChance = decision, reason, chance
+	}
+	writeJSON(w, res)
+}
+
+// Cleaned geo data for ip, or nil when geo has none (a 404, which the
+// gatekeeper passes without consulting rules).
+func lookupGeo(c context.Context, ip string) (*rules.Meta, error) {
+	req, err := http.NewRequestWithContext(c, http.MethodGet, geoURL+"?ip="+url.QueryEscape(ip), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := geoClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var meta rules.Meta
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return nil, err
+	}
+	meta = rules.CleanMeta(meta)
+	return &meta, nil
+}
+
+/* ------------------------------- Helpers ------------------------------- */
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Returns (nil, nil) when the key does not exist
+func loadRule(c redis.Cmdable, key string) (*Rule, error) {
+	val, err := c.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rule Rule
+	if err := json.Unmarshal([]byte(val), &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// Audits a rule change (webhook event rule.<action>)
+func recordChange(r *http.Request, action, key string, old, cur *Rule) {
+	record(r, AuditEntry{Kind: "rule", Action: action, Key: key, Old: old, New: cur})
+	ruleChanges.WithLabelValues(action).Inc()
+}
+
+// Audits a deny-set change (webhook event deny.<action>), kept apart from
+// rule changes so rule.* subscribers never see IP blocks
+func recordDenyChange(r *http.Request, action, key string) {
+	record(r, AuditEntry{Kind: "deny", Action: action, Key: key})
+	denyChanges.WithLabelValues(action).Inc()
+}
+
+// Writes the audit entry and queues the webhook. Best-effort: failures are
+// logged, never surfaced to the client.
+func record(r *http.Request, entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	entry.Origin = r.Header.Get("Origin")
+	entry.Remote = clientAddr(r)
+	entry.RequestID = r.Header.Get("X-Request-ID")
+	data, _ := json.Marshal(entry)
+	if auditStdout {
+		log.Printf("[AUDIT] %s", data)
+	}
+	pipe := rdb.TxPipeline()
+	pipe.LPush(ctx, auditKey, data)
+	pipe.LTrim(ctx, auditKey, 0, auditMax-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[WARN] audit write failed for %s: %v", entry.Key, err)
+	}
+	enqueueWebhook(entry)
+}
+
+func storedRule(key string, rule Rule, expiry time.Duration) StoredRule {
+	remaining := -1
+	if expiry > 0 {
+		remaining = int(expiry.Round(time.Second) / time.Second)
+	}
+	return StoredRule{Rule: rule, Key: key, RemainingTTL: remaining}
+}
+
+func writeStored(w http.ResponseWriter, status int, msg string, sr StoredRule) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":   true,
+		"msg":  msg,
+		"rule": sr,
+	})
+}
+
+func rejectRule(w http.ResponseWriter, reason, msg string) {
+	ruleRejections.WithLabelValues(reason).Inc()
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+// 409 for a create over MAX_RULES
+func rejectRuleCap(w http.ResponseWriter) {
+	ruleRejections.WithLabelValues("max_rules").Inc()
+	http.Error(w, fmt.Sprintf("rule limit reached: MAX_RULES=%d rules already exist; delete some (or let them expire) before creating more", maxRules), http.StatusConflict)
+}
+
+// Claims room for one new rule under MAX_RULES. The count comes from a
+// SCAN at most ruleCapTTL old, plus the creates claimed since, so a burst
+// of POSTs can't overshoot the cap between scans. Updates never call it.
+func reserveRuleSlot() error {
+	if maxRules == 0 {
+		return nil
+	}
+	ruleCap.mu.Lock()
+	defer ruleCap.mu.Unlock()
+	if time.Since(ruleCap.at) > ruleCapTTL {
+		n, err := scanRuleCount()
+		if err != nil {
+			return err
+		}
+		ruleCap.n, ruleCap.at = n, time.Now()
+	}
+	if ruleCap.n >= maxRules {
+		return errRuleCap
+	}
+	ruleCap.n++
+	return nil
+}
+
+// Gives back a slot: a claimed create that failed, or a delete
+func releaseRuleSlot() {
+	ruleCap.mu.Lock()
+	if ruleCap.n > 0 {
+		ruleCap.n--
+	}
+	ruleCap.mu.Unlock()
+}
+
+// Writes each rule in the seed file (normalized and validated like a POST)
+// with its TTL. if-absent uses SETNX so rules already in Redis win. An
+// unreadable file is fatal; invalid entries and write errors are logged.
+func seedRules(path, mode string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("RULES_SEED_FILE: %v", err)
+	}
+	var seed []Rule
+	if err := json.Unmarshal(data, &seed); err != nil {
+		log.Fatalf("RULES_SEED_FILE %s: want a JSON array of rules: %v", path, err)
+	}
+	var seeded, kept, failed int
+	for i, rule := range seed {
+		normalizeRule(&rule)
+		if err := validateRule(rule); err != nil {
+			log.Printf("[WARN] seed rule #%d: %s; skipping", i, err.msg)
+			failed++
+			continue
+		}
+		key := rules.Key(rule)
+		stamp(&rule, nil)
+		val, _ := json.Marshal(rule)
+		ttl := time.Duration(rule.TTL) * time.Second
+		if mode == "overwrite" {
+			err = rdb.Set(ctx, key, val, ttl).Err()
+		} else {
+			var ok bool
+			ok, err = rdb.SetNX(ctx, key, val, ttl).Result()
+			if err == nil && !ok {
+				kept++
+				continue
+			}
+		}
+		if err != nil {
+			log.Printf("[WARN] seed rule %s: %v", key, err)
+			failed++
+			continue
+		}
+		seeded++
+	}
+	log.Printf("Seeded %d rules from %s (mode=%s, %d already present, %d failed)", seeded, path, mode, kept, failed)
+}
+
+// SCAN (not KEYS) so sampling never blocks Redis on large keyspaces
+func sampleRuleCount(every time.Duration) {
+	for {
+		if total, err := scanRuleCount(); err != nil {
+			log.Printf("[WARN] rule count scan failed: %v", err)
+		} else {
+			ruleCount.Set(float64(total))
+		}
+		time.Sleep(every)
+	}
+}
+
+// Rule keys across every node, by SCAN (never blocks Redis like KEYS)
+func scanRuleCount() (int, error) {
+	var (
+		mu    sync.Mutex
+		total int
+	)
+	err := forEachNode(func(node redis.Cmdable) error {
+		var (
+			cursor uint64
+			n      int
+		)
+		for {
+			keys, next, err := node.Scan(ctx, cursor, "rule:*", 500).Result()
+			if err != nil {
+				return err
+			}
+			n += len(keys)
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+		mu.Lock()
+		total += n
+		mu.Unlock()
+		return nil
+	})
+	return total, err
+}
+
+func newRedisClient(mode string, opts *redis.UniversalOptions) redis.UniversalClient {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "single":
+		return redis.NewClient(opts.Simple())
+	case "sentinel":
+		if opts.MasterName == "" {
+			log.Fatalf("REDIS_MODE=sentinel requires REDIS_MASTER_NAME")
+		}
+		return redis.NewFailoverClient(opts.Failover())
+	case "cluster":
+		return redis.NewClusterClient(opts.Cluster())
+	default:
+		log.Fatalf("invalid REDIS_MODE %q (want single, sentinel or cluster)", mode)
+		return nil
+	}
+}
+
+// Runs fn against every master: a cluster spreads rule:* keys over shards,
+// so KEYS/SCAN on one connection would only see part of them.
+func forEachNode(fn func(node redis.Cmdable) error) error {
+	if cc, ok := rdb.(*redis.ClusterClient); ok {
+		return cc.ForEachMaster(ctx, func(_ context.Context, c *redis.Client) error {
+			return fn(c)
+		})
+	}
+	return fn(rdb)
+}
+
+// Every rule key, by SCAN on each node like scanRuleCount: KEYS would
+// block Redis for the whole keyspace walk. SCAN may return a key twice;
+// each is listed once.
+func ruleKeys() ([]string, error) {
+	var (
+		mu   sync.Mutex
+		seen = map[string]bool{}
+		keys []string
+	)
+	err := forEachNode(func(node redis.Cmdable) error {
+		var cursor uint64
+		for {
+			batch, next, err := node.Scan(ctx, cursor, "rule:*", 500).Result()
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			for _, k := range batch {
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+			mu.Unlock()
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+	return keys, err
+}
+
+func clientAddr(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func preserveOrNewTTL(c redis.Cmdable, key string, ifNew time.Duration) time.Duration {
+	ttl, err := c.TTL(ctx, key).Result()
+	if err != nil {
+		return ifNew
+	}
+	switch {
+	case ttl == -2: // key not found
+		return ifNew
+	case ttl == -1: // no expire set
+		return 0
+	default:
+		return ttl // keep existing
+	}
+}
+
+// Server-side timestamps for a rule about to replace old (nil if new)
+func stamp(rule *Rule, old *Rule) {
+	now := time.Now().Unix()
+	rule.CreatedAt, rule.UpdatedAt = now, now
+	if old != nil {
+		rule.CreatedAt = old.CreatedAt
+	}
+}
+
+// Key of the rule a request addresses. Rules written before TSPs were
+// normalized live under the raw TSP, only trimmed and lower-cased; when
+// the normalized key doesn't exist but that one does, it is the rule
+// meant, so old rules can still be read, toggled and deleted.
+func targetKey(target Rule, rawTSP string) string {
+	key := rules.Key(target)
+	legacy := target
+	legacy.TSP = strings.ToLower(strings.TrimSpace(rawTSP))
+	old := rules.Key(legacy)
+	if old == key {
+		return key
+	}
+	if n, err := rdb.Exists(ctx, key).Result(); err != nil || n > 0 {
+		return key
+	}
+	if n, _ := rdb.Exists(ctx, old).Result(); n > 0 {
+		return old
+	}
+	return key
+}
+
+func normalizeRule(rule *Rule) {
+	rule.Timezone = strings.TrimSpace(rule.Timezone)
+	rule.RedirectURL = strings.TrimSpace(rule.RedirectURL)
+	rule.DropMode = strings.ToLower(strings.TrimSpace(rule.DropMode))
+	rule.Combine = strings.ToLower(strings.TrimSpace(rule.Combine))
+	rule.Country = strings.ToUpper(strings.TrimSpace(rule.Country))
+	rule.City = strings.ToLower(strings.TrimSpace(rule.City))
+	rule.UAClass = strings.ToLower(strings.TrimSpace(rule.UAClass))
+	rule.TSP = rules.NormalizeTSP(rule.TSP)
+	rule.ASN = canonicalASN(rule.ASN)
+}
+
+// "12345", "as12345", "AS 12345" → "AS12345", the form geo emits. Anything
+// else is passed through uppercased for validASN to reject.
+func canonicalASN(asn string) string {
+	asn = strings.ToUpper(strings.Join(strings.Fields(asn), ""))
+	if asn != "" && strings.Trim(asn, "0123456789") == "" {
+		return "AS" + asn
+	}
+	return asn
+}
+
+func validASN(asn string) bool {
+	if asn == "*" {
+		return true
+	}
+	digits, ok := strings.CutPrefix(asn, "AS")
+	if !ok || digits == "" {
+		return false
+	}
+	_, err := strconv.ParseUint(digits, 10, 32)
+	return err == nil
+}
+
+// ISO-3166-1 alpha-2, plus XK (Kosovo), which MaxMind emits
+var isoCountries = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, cc := range strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ
+		BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR
+		CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR
+		GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU
+		ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN KP KR KW KY KZ
+		LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ
+		MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF
+		PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI
+		SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR
+		TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW XK`) {
+		m[cc] = true
+	}
+	return m
+}()
+
+// Expects normalizeRule to have uppercased it already.
+func validCountry(cc string) bool {
+	return cc == "*" || isoCountries[cc]
+}
+
+// Fields that address an existing rule (DELETE, PATCH, toggle, lookup):
+// all three required, and each in a form that could have been written.
+func validateTarget(rule Rule) *ruleError {
+	if rule.ASN == "" || rule.Country == "" || rule.TSP == "" {
+		return &ruleError{"missing_fields", "asn, country, tsp required"}
+	}
+	return validateIDs(rule)
+}
+
+func validateIDs(rule Rule) *ruleError {
+	if rule.ASN != "" && !validASN(rule.ASN) {
+		return &ruleError{"invalid_asn", asnFormatMsg}
+	}
+	if rule.Country != "" && !validCountry(rule.Country) {
+		return &ruleError{"invalid_country", fmt.Sprintf(`country must be "*" or an ISO-3166 alpha-2 code, got %q`, rule.Country)}
+	}
+	switch rule.UAClass {
+	case "", rules.UABot, rules.UABrowser, rules.UAUnknown:
+	default:
+		return &ruleError{"invalid_ua_class", fmt.Sprintf("ua_class must be bot, browser or unknown, got %q", rule.UAClass)}
+	}
+	return nil
+}
+
+// Everything a rule being written must satisfy, including that the
+// gatekeeper would ever read its key.
+func validateRule(rule Rule) *ruleError {
+	if err := validateTarget(rule); err != nil {
+		return err
+	}
+	if !rules.Reachable(rule) {
+		return &ruleError{"unreachable_key", fmt.Sprintf("%s is never looked up by the gatekeeper; see README \"Rule keys\" for the wildcard shapes it reads", rules.Key(rule))}
+	}
+	for k := range rule.Labels {
+		if strings.TrimSpace(k) == "" || strings.Contains(k, "=") {
+			return &ruleError{"invalid_labels", "label keys must be non-empty and must not contain '='"}
+		}
+	}
+	if rule.DropPerMille != nil && (*rule.DropPerMille < 0 || *rule.DropPerMille > 1000) {
+		return &ruleError{"invalid_drop_per_mille", "drop_per_mille must be 0-1000"}
+	}
+	if rule.DropMode != "" && rule.DropMode != "sticky" && rule.DropMode != "random" {
+		return &ruleError{"invalid_drop_mode", "drop_mode must be sticky or random"}
+	}
+	if rule.Combine != "" && rule.Combine != "override" && rule.Combine != "add" && rule.Combine != "max" {
+		return &ruleError{"invalid_combine", "combine must be override, add or max"}
+	}
+	if (rule.StartHour == nil) != (rule.EndHour == nil) {
+		return &ruleError{"invalid_schedule", "start_hour and end_hour must be set together"}
+	}
+	if rule.StartHour != nil && (*rule.StartHour < 0 || *rule.StartHour > 23 || *rule.EndHour < 0 || *rule.EndHour > 23) {
+		return &ruleError{"invalid_schedule", "start_hour and end_hour must be 0-23"}
+	}
+	if rule.Timezone != "" {
+		if _, err := time.LoadLocation(rule.Timezone); err != nil {
+			return &ruleError{"invalid_schedule", "unknown timezone: " + rule.Timezone}
+		}
+	}
+	if rule.TarpitMs < 0 || rule.TarpitMs > maxTarpitMs {
+		return &ruleError{"invalid_tarpit_ms", fmt.Sprintf("tarpit_ms must be 0-%d", maxTarpitMs)}
+	}
+	if rule.RedirectURL != "" && !validRedirect(rule.RedirectURL) {
+		return &ruleError{"invalid_redirect_url", "redirect_url must be an absolute http(s) URL or a /path"}
+	}
+	return nil
+}
+
+// Every filter is "key=value" (exact match) or "key" (present with any value).
+func hasLabels(rule Rule, filters []string) bool {
+	for _, f := range filters {
+		k, v, exact := strings.Cut(f, "=")
+		got, ok := rule.Labels[k]
+		if !ok || (exact && got != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Absolute http(s) URLs, or a same-host path ("/challenge", not "//host").
+func validRedirect(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(s, "//")
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func tspListHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := ruleKeys()
+	if err != nil {
+		http.Error(w, "Redis error", http.StatusInternalServerError)
+		return
+	}
+	tspSet := make(map[string]struct{})
+	for _, key := range keys {
+		if m, ok := rules.ParseKey(key); ok && m.TSP != "" {
+			tspSet[m.TSP] = struct{}{}
+		}
+	}
+	var tsps []string
+	for tsp := range tspSet {
+		tsps = append(tsps, tsp)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tsps)
+}
+
+// Per-TSP rollup for dashboards (GET /tsp-stats)
+type TSPStats struct {
+	TSP       string   `json:"tsp"`
+	Rules     int      `json:"rules"`
+	Enabled   int      `json:"enabled"`
+	Countries []string `json:"countries"`
+	ASNs      []string `json:"asns"`
+}
+
+// Groups every rule by TSP from the parsed keys, in one SCAN pass per node
+// (never KEYS, which blocks Redis on a large keyspace). Each SCAN batch is
+// fetched with one pipelined GET on the same node for the enabled flags.
+// Rules that expire mid-scan are left out.
+func tspStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		mu    sync.Mutex
+		seen  = map[string]bool{} // SCAN may return a key more than once
+		byTSP = make(map[string]*TSPStats)
+	)
+	add := func(m rules.Meta, rule Rule) {
+		st := byTSP[m.TSP]
+		if st == nil {
+			st = &TSPStats{TSP: m.TSP, Countries: []string{}, ASNs: []string{}}
+			byTSP[m.TSP] = st
+		}
+		st.Rules++
+		if rule.Enabled {
+			st.Enabled++
+		}
+		if !slices.Contains(st.Countries, m.Country) {
+			st.Countries = append(st.Countries, m.Country)
+		}
+		if !slices.Contains(st.ASNs, m.ASN) {
+			st.ASNs = append(st.ASNs, m.ASN)
+		}
+	}
+	err := forEachNode(func(node redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, "rule:*", 500).Result()
+			if err != nil {
+				return err
+			}
+			pipe := node.Pipeline()
+			gets := make([]*redis.StringCmd, len(keys))
+			for i, key := range keys {
+				gets[i] = pipe.Get(ctx, key)
+			}
+			if len(keys) > 0 {
+				if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+					return err
+				}
+			}
+			mu.Lock()
+			for i, key := range keys {
+				m, ok := rules.ParseKey(key)
+				if !ok || m.TSP == "" || seen[key] {
+					continue
+				}
+				val, err := gets[i].Result()
+				if err != nil {
+					continue
+				}
+				var rule Rule
+				if json.Unmarshal([]byte(val), &rule) != nil {
+					continue
+				}
+				seen[key] = true
+				add(m, rule)
+			}
+			mu.Unlock()
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		http.Error(w, "Redis read error", http.StatusInternalServerError)
+		return
+	}
+	stats := make([]TSPStats, 0, len(byTSP))
+	for _, st := range byTSP {
+		slices.Sort(st.Countries)
+		slices.Sort(st.ASNs)
+		stats = append(stats, *st)
+	}
+	// Busiest first, then by name so the order is stable
+	slices.SortFunc(stats, func(a, b TSPStats) int {
+		if a.Rules != b.Rules {
+			return b.Rules - a.Rules
+		}
+		return strings.Compare(a.TSP, b.TSP)
+	})
+	writeJSON(w, stats)
 }
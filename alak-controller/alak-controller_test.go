@@ -0,0 +1,1104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/alak-common/rules"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseExpiresAtBoundary(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 500*int(time.Millisecond), time.UTC)
+	sec := now.Unix() // 12:00:00, half a second behind now
+
+	cases := []struct {
+		raw     string
+		want    time.Duration
+		ttl     int
+		invalid bool
+	}{
+		{raw: ``},
+		{raw: `null`},
+		{raw: fmt.Sprint(sec + 1), want: 500 * time.Millisecond, ttl: 1},
+		{raw: fmt.Sprintf(`"%d"`, sec+1), want: 500 * time.Millisecond, ttl: 1},
+		{raw: fmt.Sprint(sec), invalid: true}, // same second, already passed
+		{raw: `"2026-10-16T12:00:00.5Z"`, invalid: true},
+		{raw: `"2026-10-16T12:00:00.500000001Z"`, want: time.Nanosecond, ttl: 1},
+		{raw: `"2026-10-16T12:00:01.9Z"`, want: 1400 * time.Millisecond, ttl: 1},
+		{raw: `"2026-10-16T12:00:02Z"`, want: 1500 * time.Millisecond, ttl: 2},
+		{raw: `"2026-10-16T14:00:00+02:00"`, invalid: true}, // 12:00:00Z
+		{raw: `"2026-10-16T14:00:01+02:00"`, want: 500 * time.Millisecond, ttl: 1},
+		{raw: `"2026-10-17T00:00:00Z"`, want: 11*time.Hour + 59*time.Minute + 59500*time.Millisecond, ttl: 43200},
+		{raw: fmt.Sprint(float64(sec) + 1.5), invalid: true},
+		{raw: `"tomorrow"`, invalid: true},
+		{raw: `true`, invalid: true},
+	}
+	for _, tc := range cases {
+		d, ok, rerr := parseExpiresAt(json.RawMessage(tc.raw), now)
+		switch {
+		case tc.invalid:
+			if rerr == nil || rerr.reason != "invalid_expires_at" {
+				t.Errorf("%s: got %v, %v, %v; want invalid_expires_at", tc.raw, d, ok, rerr)
+			}
+		case rerr != nil:
+			t.Errorf("%s: unexpected error %v", tc.raw, rerr)
+		case tc.want == 0:
+			if ok {
+				t.Errorf("%s: ok with %v, want absent", tc.raw, d)
+			}
+		default:
+			if !ok || d != tc.want {
+				t.Errorf("%s: got %v (ok=%v), want %v", tc.raw, d, ok, tc.want)
+			}
+			if got := ttlSeconds(d); got != tc.ttl {
+				t.Errorf("%s: ttl %d, want %d", tc.raw, got, tc.ttl)
+			}
+		}
+	}
+}
+
+func TestDecodeRuleWriteExpiresAt(t *testing.T) {
+	decode := func(body string) (Rule, time.Duration, bool, *ruleError) {
+		var rule Rule
+		r := httptest.NewRequest(http.MethodPost, "/rules", strings.NewReader(body))
+		ttl, exact, rerr := decodeRuleWrite(r, &rule)
+		return rule, ttl, exact, rerr
+	}
+	const base = `"asn":"AS44244","country":"IR","tsp":"irancell","drop_percent":50,"enabled":true`
+
+	// One second ahead in Unix seconds leaves (0, 1s]: never 0 or less,
+	// which would store a permanent rule
+	rule, ttl, exact, rerr := decode(fmt.Sprintf(`{%s,"ttl":3600,"expires_at":%d}`, base, time.Now().Unix()+1))
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	if !exact || ttl <= 0 || ttl > time.Second || rule.TTL != 1 {
+		t.Errorf("expires_at 1s ahead: ttl %v exact %v rule.TTL %d; want (0, 1s], true, 1", ttl, exact, rule.TTL)
+	}
+
+	if _, _, _, rerr := decode(fmt.Sprintf(`{%s,"expires_at":%d}`, base, time.Now().Unix()-1)); rerr == nil || rerr.reason != "invalid_expires_at" {
+		t.Errorf("past expires_at: got %v, want invalid_expires_at", rerr)
+	}
+
+	rule, ttl, exact, rerr = decode(fmt.Sprintf(`{%s,"ttl":60}`, base))
+	if rerr != nil || exact || ttl != time.Minute || rule.TTL != 60 {
+		t.Errorf("ttl only: %v %v %d %v; want 1m, false, 60", ttl, exact, rule.TTL, rerr)
+	}
+}
+
+// A single-node Redis in memory, speaking just enough RESP2 for the
+// commands the controller sends: strings with expiry, lists, sets, sorted
+// sets, SCAN/KEYS and WATCH/MULTI/EXEC with real conflict detection.
+type memRedis struct {
+	mu   sync.Mutex
+	vals map[string]any // string | []string | map[string]bool | map[string]float64
+	exp  map[string]time.Time
+	ver  map[string]int // bumped on every write, for WATCH
+	cmds []string       // command names, in order
+
+	// Run once, just before the next EXEC: a write from another client
+	// landing between a handler's read and its transaction
+	beforeExec func()
+}
+
+// Points rdb at a fresh memRedis for the test.
+func useMemRedis(t *testing.T) *memRedis {
+	t.Helper()
+	m := &memRedis{vals: map[string]any{}, exp: map[string]time.Time{}, ver: map[string]int{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.handle(conn)
+		}
+	}()
+	old := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: ln.Addr().String(), MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = rdb.Close()
+		ln.Close()
+		rdb = old
+	})
+	return m
+}
+
+// Reply shapes beyond bulk strings (string), integers (int) and nil
+type (
+	status   string
+	errReply string
+	nilArray struct{}
+)
+
+type memConn struct {
+	watched map[string]int
+	queued  [][]string // nil outside MULTI
+}
+
+func (m *memRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	c := &memConn{}
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		var b strings.Builder
+		writeReply(&b, m.run(c, args))
+		if _, err := io.WriteString(conn, b.String()); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeReply(b *strings.Builder, v any) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("$-1\r\n")
+	case nilArray:
+		b.WriteString("*-1\r\n")
+	case status:
+		fmt.Fprintf(b, "+%s\r\n", v)
+	case errReply:
+		fmt.Fprintf(b, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(b, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(b, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(b, "*%d\r\n", len(v))
+		for _, s := range v {
+			writeReply(b, s)
+		}
+	case []any:
+		fmt.Fprintf(b, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(b, e)
+		}
+	default:
+		panic(fmt.Sprintf("memRedis: no reply encoding for %T", v))
+	}
+}
+
+func (m *memRedis) run(c *memConn, args []string) any {
+	name := strings.ToLower(args[0])
+	if name == "exec" {
+		m.mu.Lock()
+		hook := m.beforeExec
+		m.beforeExec = nil
+		m.mu.Unlock()
+		if hook != nil {
+			hook()
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cmds = append(m.cmds, name)
+	switch {
+	case name == "multi":
+		c.queued = [][]string{}
+		return status("OK")
+	case name == "discard":
+		c.queued, c.watched = nil, nil
+		return status("OK")
+	case name == "exec":
+		queued, watched := c.queued, c.watched
+		c.queued, c.watched = nil, nil
+		for k, v := range watched {
+			m.live(k)
+			if m.ver[k] != v {
+				return nilArray{}
+			}
+		}
+		out := make([]any, len(queued))
+		for i, q := range queued {
+			out[i] = m.exec(q)
+		}
+		return out
+	case c.queued != nil:
+		c.queued = append(c.queued, args)
+		return status("QUEUED")
+	case name == "watch":
+		if c.watched == nil {
+			c.watched = map[string]int{}
+		}
+		for _, k := range args[1:] {
+			m.live(k)
+			c.watched[k] = m.ver[k]
+		}
+		return status("OK")
+	case name == "unwatch":
+		c.watched = nil
+		return status("OK")
+	}
+	return m.exec(args)
+}
+
+// Drops k if it has expired; reports whether it exists.
+func (m *memRedis) live(k string) bool {
+	if at, ok := m.exp[k]; ok && !time.Now().Before(at) {
+		delete(m.vals, k)
+		delete(m.exp, k)
+		m.ver[k]++
+	}
+	_, ok := m.vals[k]
+	return ok
+}
+
+func (m *memRedis) touch(k string) { m.ver[k]++ }
+
+// Sets a key directly, as a rule written by an older version would be.
+func (m *memRedis) set(k, v string, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.vals[k] = v
+	delete(m.exp, k)
+	if ttl > 0 {
+		m.exp[k] = time.Now().Add(ttl)
+	}
+	m.touch(k)
+}
+
+func (m *memRedis) get(k string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.live(k) {
+		return "", false
+	}
+	v, ok := m.vals[k].(string)
+	return v, ok
+}
+
+func (m *memRedis) ttl(k string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if at, ok := m.exp[k]; ok && m.live(k) {
+		return time.Until(at)
+	}
+	return 0
+}
+
+func (m *memRedis) commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.cmds)
+}
+
+func globRegexp(pattern string) *regexp.Regexp {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.ReplaceAll(re, `\*`, `.*`)
+	re = strings.ReplaceAll(re, `\?`, `.`)
+	return regexp.MustCompile("^" + re + "$")
+}
+
+func (m *memRedis) sortedKeys(pattern string) []string {
+	re := globRegexp(pattern)
+	var keys []string
+	for k := range m.vals {
+		if m.live(k) && re.MatchString(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *memRedis) exec(args []string) any {
+	name := strings.ToLower(args[0])
+	wrongType := errReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+	switch name {
+	case "ping":
+		return status("PONG")
+	case "get":
+		if !m.live(args[1]) {
+			return nil
+		}
+		v, ok := m.vals[args[1]].(string)
+		if !ok {
+			return wrongType
+		}
+		return v
+	case "set", "setnx":
+		k, v := args[1], args[2]
+		var (
+			ttl          time.Duration
+			nx, xx, keep bool
+		)
+		nx = name == "setnx"
+		for i := 3; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "ex", "px":
+				n, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(n) * time.Second
+				if strings.EqualFold(args[i], "px") {
+					ttl = time.Duration(n) * time.Millisecond
+				}
+				i++
+			case "nx":
+				nx = true
+			case "xx":
+				xx = true
+			case "keepttl":
+				keep = true
+			}
+		}
+		exists := m.live(k)
+		if (nx && exists) || (xx && !exists) {
+			if name == "setnx" {
+				return 0
+			}
+			return nil
+		}
+		m.vals[k] = v
+		if !keep {
+			delete(m.exp, k)
+		}
+		if ttl > 0 {
+			m.exp[k] = time.Now().Add(ttl)
+		}
+		m.touch(k)
+		if name == "setnx" {
+			return 1
+		}
+		return status("OK")
+	case "del", "unlink", "exists":
+		n := 0
+		for _, k := range args[1:] {
+			if m.live(k) {
+				n++
+				if name != "exists" {
+					delete(m.vals, k)
+					delete(m.exp, k)
+					m.touch(k)
+				}
+			}
+		}
+		return n
+	case "ttl", "pttl":
+		if !m.live(args[1]) {
+			return -2
+		}
+		at, ok := m.exp[args[1]]
+		if !ok {
+			return -1
+		}
+		if name == "pttl" {
+			return int(time.Until(at) / time.Millisecond)
+		}
+		return int((time.Until(at) + time.Second/2) / time.Second)
+	case "pexpire", "expire":
+		if !m.live(args[1]) {
+			return 0
+		}
+		n, _ := strconv.Atoi(args[2])
+		d := time.Duration(n) * time.Millisecond
+		if name == "expire" {
+			d = time.Duration(n) * time.Second
+		}
+		m.exp[args[1]] = time.Now().Add(d)
+		m.touch(args[1])
+		return 1
+	case "persist":
+		if _, ok := m.exp[args[1]]; !ok || !m.live(args[1]) {
+			return 0
+		}
+		delete(m.exp, args[1])
+		m.touch(args[1])
+		return 1
+	case "keys":
+		return m.sortedKeys(args[1])
+	case "scan":
+		cursor, _ := strconv.Atoi(args[1])
+		pattern, count := "*", 10
+		for i := 2; i+1 < len(args); i += 2 {
+			switch strings.ToLower(args[i]) {
+			case "match":
+				pattern = args[i+1]
+			case "count":
+				count, _ = strconv.Atoi(args[i+1])
+			}
+		}
+		// The cursor is an offset into every key in order; MATCH filters
+		// each batch, as Redis does
+		all := m.sortedKeys("*")
+		end := min(cursor+count, len(all))
+		re := globRegexp(pattern)
+		batch := []string{}
+		for _, k := range all[min(cursor, len(all)):end] {
+			if re.MatchString(k) {
+				batch = append(batch, k)
+			}
+		}
+		next := end
+		if end >= len(all) {
+			next = 0
+		}
+		return []any{strconv.Itoa(next), batch}
+	case "lpush":
+		l, _ := m.vals[args[1]].([]string)
+		for _, v := range args[2:] {
+			l = append([]string{v}, l...)
+		}
+		m.vals[args[1]] = l
+		m.touch(args[1])
+		return len(l)
+	case "ltrim", "lrange":
+		l, _ := m.vals[args[1]].([]string)
+		start, _ := strconv.Atoi(args[2])
+		stop, _ := strconv.Atoi(args[3])
+		if start < 0 {
+			start = max(len(l)+start, 0)
+		}
+		if stop < 0 {
+			stop = len(l) + stop
+		}
+		stop = min(stop, len(l)-1)
+		var part []string
+		if start <= stop {
+			part = slices.Clone(l[start : stop+1])
+		}
+		if name == "lrange" {
+			if part == nil {
+				part = []string{}
+			}
+			return part
+		}
+		m.vals[args[1]] = part
+		m.touch(args[1])
+		return status("OK")
+	case "sadd", "srem":
+		s, _ := m.vals[args[1]].(map[string]bool)
+		if s == nil {
+			s = map[string]bool{}
+		}
+		n := 0
+		for _, v := range args[2:] {
+			if s[v] != (name == "sadd") {
+				n++
+			}
+			if name == "sadd" {
+				s[v] = true
+			} else {
+				delete(s, v)
+			}
+		}
+		m.vals[args[1]] = s
+		m.touch(args[1])
+		return n
+	case "smembers":
+		s, _ := m.vals[args[1]].(map[string]bool)
+		out := []string{}
+		for v := range s {
+			out = append(out, v)
+		}
+		sort.Strings(out)
+		return out
+	case "zadd":
+		z, _ := m.vals[args[1]].(map[string]float64)
+		if z == nil {
+			z = map[string]float64{}
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			score, _ := strconv.ParseFloat(args[i], 64)
+			if _, ok := z[args[i+1]]; !ok {
+				n++
+			}
+			z[args[i+1]] = score
+		}
+		m.vals[args[1]] = z
+		m.touch(args[1])
+		return n
+	case "zrem":
+		z, _ := m.vals[args[1]].(map[string]float64)
+		n := 0
+		for _, v := range args[2:] {
+			if _, ok := z[v]; ok {
+				delete(z, v)
+				n++
+			}
+		}
+		m.touch(args[1])
+		return n
+	case "zrange", "zrangebyscore":
+		z, _ := m.vals[args[1]].(map[string]float64)
+		members := make([]string, 0, len(z))
+		for v := range z {
+			members = append(members, v)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if z[members[i]] != z[members[j]] {
+				return z[members[i]] < z[members[j]]
+			}
+			return members[i] < members[j]
+		})
+		withScores := strings.EqualFold(args[len(args)-1], "withscores")
+		if name == "zrangebyscore" {
+			lo, hi := scoreBound(args[2]), scoreBound(args[3])
+			var in []string
+			for _, v := range members {
+				if z[v] >= lo && z[v] <= hi {
+					in = append(in, v)
+				}
+			}
+			members = in
+		} else {
+			start, _ := strconv.Atoi(args[2])
+			stop, _ := strconv.Atoi(args[3])
+			if stop < 0 {
+				stop = len(members) + stop
+			}
+			stop = min(stop, len(members)-1)
+			if start > stop {
+				members = nil
+			} else {
+				members = members[start : stop+1]
+			}
+		}
+		out := []string{}
+		for _, v := range members {
+			out = append(out, v)
+			if withScores {
+				out = append(out, strconv.FormatFloat(z[v], 'f', -1, 64))
+			}
+		}
+		return out
+	case "config":
+		return []string{args[2], ""}
+	case "publish":
+		return 0
+	}
+	return errReply("ERR unknown command '" + args[0] + "'")
+}
+
+func scoreBound(s string) float64 {
+	switch s {
+	case "-inf":
+		return -1e308
+	case "+inf", "inf":
+		return 1e308
+	}
+	f, _ := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+	return f
+}
+
+// Rules stored before TSPs were normalized keep their old key, lower-cased
+// only; asking for them by that spelling still reaches them.
+func TestLegacyTSPKey(t *testing.T) {
+	m := useMemRedis(t)
+	legacy := rules.Key(Rule{ASN: "AS7018", Country: "US", TSP: "at&t services, inc."})
+	m.set(legacy, `{"asn":"AS7018","country":"US","tsp":"at&t services, inc.","drop_percent":10,"enabled":true}`, 0)
+	q := "asn=AS7018&country=US&tsp=" + url.QueryEscape("AT&T Services, Inc.")
+
+	w := httptest.NewRecorder()
+	ruleOneHandler(w, httptest.NewRequest(http.MethodGet, "/rules/one?"+q, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"drop_percent":10`) {
+		t.Fatalf("GET /rules/one: %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	toggleRuleHandler(w, httptest.NewRequest(http.MethodPost, "/toggle-rule",
+		strings.NewReader(`{"asn":"AS7018","country":"US","tsp":"AT&T Services, Inc.","enabled":false}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("toggle: %d %s", w.Code, w.Body)
+	}
+	if v, _ := m.get(legacy); !strings.Contains(v, `"enabled":false`) {
+		t.Errorf("toggle didn't reach the legacy key: %s", v)
+	}
+
+	w = httptest.NewRecorder()
+	rulesHandler(w, httptest.NewRequest(http.MethodDelete, "/rules?"+q, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if _, ok := m.get(legacy); ok {
+		t.Errorf("%s still stored after DELETE", legacy)
+	}
+}
+
+// A normalized rule wins over a legacy one at the same address.
+func TestLegacyTSPKeyNormalizedFirst(t *testing.T) {
+	m := useMemRedis(t)
+	legacy := rules.Key(Rule{ASN: "AS7018", Country: "US", TSP: "at&t services, inc."})
+	current := rules.Key(Rule{ASN: "AS7018", Country: "US", TSP: "at t services"})
+	m.set(legacy, `{"asn":"AS7018","country":"US","tsp":"at&t services, inc.","enabled":true}`, 0)
+	m.set(current, `{"asn":"AS7018","country":"US","tsp":"at t services","enabled":true}`, 0)
+
+	w := httptest.NewRecorder()
+	rulesHandler(w, httptest.NewRequest(http.MethodDelete, "/rules?asn=AS7018&country=US&tsp="+url.QueryEscape("AT&T Services, Inc."), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if _, ok := m.get(current); ok {
+		t.Errorf("%s still stored", current)
+	}
+	if _, ok := m.get(legacy); !ok {
+		t.Errorf("%s deleted in place of the normalized rule", legacy)
+	}
+}
+
+// Sends body to h as method on path and returns the recorder.
+func call(h http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestPatchKeepsOmittedFieldsAndExpiry(t *testing.T) {
+	m := useMemRedis(t)
+	const id = `"asn":"AS44244","country":"IR","tsp":"irancell"`
+	key := "rule:AS44244:IR:irancell"
+	if w := call(rulesHandler, http.MethodPost, "/rules", `{`+id+`,"drop_percent":50,"enabled":true,"drop_mode":"random","start_hour":8,"end_hour":20,"labels":{"team":"noc"},"ttl":3600}`); w.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+
+	if w := call(rulesHandler, http.MethodPatch, "/rules", `{`+id+`,"drop_percent":40}`); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: %d %s", w.Code, w.Body)
+	}
+	v, _ := m.get(key)
+	var got Rule
+	if err := json.Unmarshal([]byte(v), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.DropPercent != 40 || !got.Enabled || got.DropMode != "random" || got.StartHour == nil || *got.StartHour != 8 ||
+		got.EndHour == nil || *got.EndHour != 20 || got.Labels["team"] != "noc" || got.TTL != 3600 {
+		t.Errorf("after PATCH of drop_percent: %s", v)
+	}
+	if ttl := m.ttl(key); ttl < 3590*time.Second || ttl > time.Hour {
+		t.Errorf("expiry after PATCH: %v, want the original ~1h", ttl)
+	}
+
+	// The stored ttl may be echoed back, not changed; expires_at never applies
+	if w := call(rulesHandler, http.MethodPatch, "/rules", `{`+id+`,"ttl":3600,"drop_percent":30}`); w.Code != http.StatusOK {
+		t.Errorf("PATCH echoing ttl: %d %s", w.Code, w.Body)
+	}
+	for body, reason := range map[string]string{
+		`{` + id + `,"ttl":60}`:                                       "invalid_ttl",
+		`{` + id + `,"ttl":0}`:                                        "invalid_ttl",
+		`{` + id + `,"expires_at":"2099-01-01T00:00:00Z"}`:            "invalid_expires_at",
+		fmt.Sprintf(`{%s,"expires_at":%d}`, id, time.Now().Unix()+60): "invalid_expires_at",
+	} {
+		before := testutil.ToFloat64(ruleRejections.WithLabelValues(reason))
+		w := call(rulesHandler, http.MethodPatch, "/rules", body)
+		if w.Code != http.StatusBadRequest || testutil.ToFloat64(ruleRejections.WithLabelValues(reason)) != before+1 {
+			t.Errorf("PATCH %s: %d %s, want 400 %s", body, w.Code, w.Body, reason)
+		}
+	}
+	v, _ = m.get(key)
+	if !strings.Contains(v, `"drop_percent":30`) || !strings.Contains(v, `"ttl":3600`) {
+		t.Errorf("refused PATCHes changed the rule: %s", v)
+	}
+	if ttl := m.ttl(key); ttl < 3590*time.Second {
+		t.Errorf("expiry after refused PATCHes: %v", ttl)
+	}
+}
+
+// GET /rules and /tsp-list walk the keyspace with SCAN, across batches,
+// and never send KEYS.
+func TestRuleListingsScan(t *testing.T) {
+	m := useMemRedis(t)
+	const n = 1203 // a few SCAN batches of 500
+	for i := 0; i < n; i++ {
+		tsp := fmt.Sprintf("tsp%d", i%3)
+		m.set(rules.Key(Rule{ASN: fmt.Sprintf("AS%d", i), Country: "IR", TSP: tsp}),
+			fmt.Sprintf(`{"asn":"AS%d","country":"IR","tsp":"%s","drop_percent":10,"enabled":true}`, i, tsp), 0)
+	}
+	m.set("deny:ip", "not a rule", 0)
+	m.set(auditKey, "not a rule either", 0)
+
+	w := call(rulesHandler, http.MethodGet, "/rules", "")
+	var listed []StoredRule
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("GET /rules: %v: %.200s", err, w.Body)
+	}
+	if len(listed) != n {
+		t.Errorf("GET /rules listed %d rules, want %d", len(listed), n)
+	}
+
+	w = call(tspListHandler, http.MethodGet, "/tsp-list", "")
+	var tsps []string
+	if err := json.Unmarshal(w.Body.Bytes(), &tsps); err != nil {
+		t.Fatalf("GET /tsp-list: %v: %s", err, w.Body)
+	}
+	slices.Sort(tsps)
+	if !slices.Equal(tsps, []string{"tsp0", "tsp1", "tsp2"}) {
+		t.Errorf("GET /tsp-list = %q", tsps)
+	}
+
+	cmds := m.commands()
+	if slices.Contains(cmds, "keys") {
+		t.Error("KEYS sent")
+	}
+	if scans := len(slices.DeleteFunc(cmds, func(c string) bool { return c != "scan" })); scans < 2*3 {
+		t.Errorf("%d SCAN calls, want at least 3 per listing", scans)
+	}
+}
+
+// An edit landing between a handler's read and its write makes the handler
+// answer 409 and leaves the other edit in place; a retry then applies on
+// top of it and keeps the expiry.
+func TestConcurrentUpdateConflicts(t *testing.T) {
+	m := useMemRedis(t)
+	const id = `"asn":"AS44244","country":"IR","tsp":"irancell"`
+	key := "rule:AS44244:IR:irancell"
+	if w := call(rulesHandler, http.MethodPost, "/rules", `{`+id+`,"drop_percent":50,"enabled":true,"ttl":3600}`); w.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	other := `{` + id + `,"drop_percent":70,"enabled":true,"ttl":3600}`
+
+	for _, tc := range []struct {
+		name   string
+		h      http.HandlerFunc
+		method string
+		path   string
+		body   string
+	}{
+		{"PATCH", rulesHandler, http.MethodPatch, "/rules", `{` + id + `,"drop_percent":20}`},
+		{"PUT", rulesHandler, http.MethodPut, "/rules", `{` + id + `,"drop_percent":20,"enabled":true}`},
+		{"toggle", toggleRuleHandler, http.MethodPost, "/toggle-rule", `{` + id + `,"enabled":false}`},
+	} {
+		m.mu.Lock()
+		m.beforeExec = func() { m.set(key, other, time.Hour) }
+		m.mu.Unlock()
+		if w := call(tc.h, tc.method, tc.path, tc.body); w.Code != http.StatusConflict {
+			t.Errorf("%s racing another edit: %d %s, want 409", tc.name, w.Code, w.Body)
+		}
+		if v, _ := m.get(key); v != other {
+			t.Errorf("%s clobbered the concurrent edit: %s", tc.name, v)
+		}
+
+		if w := call(tc.h, tc.method, tc.path, tc.body); w.Code != http.StatusOK {
+			t.Errorf("%s retry: %d %s", tc.name, w.Code, w.Body)
+		}
+		if ttl := m.ttl(key); ttl < 3590*time.Second || ttl > time.Hour {
+			t.Errorf("%s retry: expiry %v, want the stored ~1h", tc.name, ttl)
+		}
+	}
+}
+
+// Every accepted ASN spelling is stored as AS<number>, and reaches the same
+// rule from DELETE and toggle.
+func TestASNInputVariants(t *testing.T) {
+	m := useMemRedis(t)
+	const key = "rule:AS12345:IR:*"
+	for _, asn := range []string{"12345", "as12345", "AS12345", " AS 12345 ", "As12345"} {
+		w := call(rulesHandler, http.MethodPost, "/rules", fmt.Sprintf(`{"asn":%q,"country":"IR","tsp":"*","drop_percent":10,"enabled":true}`, asn))
+		if w.Code != http.StatusCreated {
+			t.Errorf("POST asn %q: %d %s", asn, w.Code, w.Body)
+		}
+		if v, ok := m.get(key); !ok || !strings.Contains(v, `"asn":"AS12345"`) {
+			t.Errorf("POST asn %q: %s = %q", asn, key, v)
+		}
+
+		if w := call(toggleRuleHandler, http.MethodPost, "/toggle-rule", fmt.Sprintf(`{"asn":%q,"country":"IR","tsp":"*","enabled":false}`, asn)); w.Code != http.StatusOK {
+			t.Errorf("toggle asn %q: %d %s", asn, w.Code, w.Body)
+		}
+		if w := call(rulesHandler, http.MethodDelete, "/rules?country=IR&tsp=*&asn="+url.QueryEscape(asn), ""); w.Code != http.StatusOK {
+			t.Errorf("DELETE asn %q: %d %s", asn, w.Code, w.Body)
+		}
+		if _, ok := m.get(key); ok {
+			t.Errorf("DELETE asn %q left %s", asn, key)
+		}
+	}
+
+	for _, asn := range []string{"AS12x45", "ASN12345", "AS", "12.5", "AS-1", "AS99999999999"} {
+		before := testutil.ToFloat64(ruleRejections.WithLabelValues("invalid_asn"))
+		w := call(rulesHandler, http.MethodPost, "/rules", fmt.Sprintf(`{"asn":%q,"country":"IR","tsp":"*","drop_percent":10,"enabled":true}`, asn))
+		if w.Code != http.StatusBadRequest || testutil.ToFloat64(ruleRejections.WithLabelValues("invalid_asn")) != before+1 {
+			t.Errorf("POST asn %q: %d %s, want 400 invalid_asn", asn, w.Code, w.Body)
+		}
+	}
+}
+
+// TSPs with colons and spaces: new writes normalize the colon away, and a
+// rule stored under its escaped raw name (before normalization) still lists,
+// parses and is reachable by that name.
+func TestTSPWithColonsAndSpaces(t *testing.T) {
+	m := useMemRedis(t)
+	if w := call(rulesHandler, http.MethodPost, "/rules", `{"asn":"AS1","country":"US","tsp":"Foo:Bar Telecom","drop_percent":10,"enabled":true}`); w.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", w.Code, w.Body)
+	}
+	if _, ok := m.get("rule:AS1:US:foo bar telecom"); !ok {
+		t.Error("POST didn't store rule:AS1:US:foo bar telecom")
+	}
+
+	legacy := rules.Key(Rule{ASN: "AS2", Country: "US", TSP: "foo:bar telecom"})
+	if legacy != "rule:AS2:US:foo%3Abar telecom" {
+		t.Fatalf("legacy key %q", legacy)
+	}
+	m.set(legacy, `{"asn":"AS2","country":"US","tsp":"foo:bar telecom","drop_percent":20,"enabled":true}`, 0)
+
+	w := call(tspListHandler, http.MethodGet, "/tsp-list", "")
+	var tsps []string
+	if err := json.Unmarshal(w.Body.Bytes(), &tsps); err != nil {
+		t.Fatalf("GET /tsp-list: %v: %s", err, w.Body)
+	}
+	slices.Sort(tsps)
+	if !slices.Equal(tsps, []string{"foo bar telecom", "foo:bar telecom"}) {
+		t.Errorf("GET /tsp-list = %q", tsps)
+	}
+
+	w = call(tspStatsHandler, http.MethodGet, "/tsp-stats", "")
+	var stats []TSPStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("GET /tsp-stats: %v: %s", err, w.Body)
+	}
+	for _, st := range stats {
+		if st.Rules != 1 || !slices.Equal(st.Countries, []string{"US"}) {
+			t.Errorf("GET /tsp-stats: %+v", st)
+		}
+	}
+	if len(stats) != 2 {
+		t.Errorf("GET /tsp-stats: %d TSPs, want 2", len(stats))
+	}
+
+	q := "asn=AS2&country=US&tsp=" + url.QueryEscape("foo:bar telecom")
+	if w := call(ruleOneHandler, http.MethodGet, "/rules/one?"+q, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"drop_percent":20`) {
+		t.Errorf("GET /rules/one: %d %s", w.Code, w.Body)
+	}
+	if w := call(toggleRuleHandler, http.MethodPost, "/toggle-rule", `{"asn":"AS2","country":"US","tsp":"foo:bar telecom","enabled":false}`); w.Code != http.StatusOK {
+		t.Errorf("toggle: %d %s", w.Code, w.Body)
+	}
+	if v, _ := m.get(legacy); !strings.Contains(v, `"enabled":false`) {
+		t.Errorf("toggle didn't reach %s: %s", legacy, v)
+	}
+	if w := call(rulesHandler, http.MethodDelete, "/rules?"+q, ""); w.Code != http.StatusOK {
+		t.Errorf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if _, ok := m.get(legacy); ok {
+		t.Errorf("%s still stored after DELETE", legacy)
+	}
+}
+
+func TestCountryCodes(t *testing.T) {
+	m := useMemRedis(t)
+	post := func(country string) *httptest.ResponseRecorder {
+		return call(rulesHandler, http.MethodPost, "/rules", fmt.Sprintf(`{"asn":"AS1","country":%q,"tsp":"*","drop_percent":10,"enabled":true}`, country))
+	}
+	rejects := func(what, reason string, w *httptest.ResponseRecorder, before float64) {
+		t.Helper()
+		if w.Code != http.StatusBadRequest || testutil.ToFloat64(ruleRejections.WithLabelValues(reason)) != before+1 {
+			t.Errorf("%s: %d %s, want 400 %s", what, w.Code, w.Body, reason)
+		}
+	}
+
+	before := testutil.ToFloat64(ruleRejections.WithLabelValues("invalid_country"))
+	w := post("USA")
+	rejects("POST USA", "invalid_country", w, before)
+	if !strings.Contains(w.Body.String(), `"USA"`) {
+		t.Errorf("POST USA: message %q doesn't name the value", w.Body)
+	}
+	if w := post("us"); w.Code != http.StatusCreated {
+		t.Errorf("POST us: %d %s", w.Code, w.Body)
+	}
+	if v, ok := m.get("rule:AS1:US:*"); !ok || !strings.Contains(v, `"country":"US"`) {
+		t.Errorf("POST us stored %q, want it as US", v)
+	}
+	if w := post("US"); w.Code != http.StatusOK {
+		t.Errorf("POST US: %d %s, want 200 updating the us rule", w.Code, w.Body)
+	}
+	before = testutil.ToFloat64(ruleRejections.WithLabelValues("missing_fields"))
+	rejects("POST empty", "missing_fields", post(""), before)
+
+	// Every handler addressing a rule refuses USA, and finds the rule by us
+	for _, tc := range []struct {
+		name   string
+		h      http.HandlerFunc
+		method string
+		path   string
+		body   func(cc string) string
+	}{
+		{"PATCH", rulesHandler, http.MethodPatch, "/rules", func(cc string) string {
+			return fmt.Sprintf(`{"asn":"AS1","country":%q,"tsp":"*","drop_percent":20}`, cc)
+		}},
+		{"toggle", toggleRuleHandler, http.MethodPost, "/toggle-rule", func(cc string) string {
+			return fmt.Sprintf(`{"asn":"AS1","country":%q,"tsp":"*"}`, cc)
+		}},
+		{"DELETE", rulesHandler, http.MethodDelete, "", nil},
+	} {
+		target := func(cc string) *httptest.ResponseRecorder {
+			if tc.body == nil {
+				return call(tc.h, tc.method, "/rules?asn=AS1&tsp=*&country="+cc, "")
+			}
+			return call(tc.h, tc.method, tc.path, tc.body(cc))
+		}
+		before := testutil.ToFloat64(ruleRejections.WithLabelValues("invalid_country"))
+		rejects(tc.name+" USA", "invalid_country", target("USA"), before)
+		before = testutil.ToFloat64(ruleRejections.WithLabelValues("missing_fields"))
+		rejects(tc.name+" empty", "missing_fields", target(""), before)
+		if w := target("us"); w.Code != http.StatusOK {
+			t.Errorf("%s us: %d %s", tc.name, w.Code, w.Body)
+		}
+	}
+	if _, ok := m.get("rule:AS1:US:*"); ok {
+		t.Error("DELETE us left rule:AS1:US:*")
+	}
+}
+
+// "*" is a first-class wildcard: stored literally in the shapes the
+// gatekeeper looks up, refused (400 unreachable_key) in any other.
+func TestWildcardKeys(t *testing.T) {
+	m := useMemRedis(t)
+	for _, tc := range []struct{ asn, country, tsp, key string }{
+		{"*", "*", "*", "rule:*:*:*"},
+		{"*", "IR", "*", "rule:*:IR:*"},
+		{"AS44244", "*", "*", "rule:AS44244:*:*"},
+		{"AS44244", "*", "irancell", "rule:AS44244:*:irancell"},
+		{"AS44244", "IR", "*", "rule:AS44244:IR:*"},
+	} {
+		body := fmt.Sprintf(`{"asn":%q,"country":%q,"tsp":%q,"drop_percent":10,"enabled":true}`, tc.asn, tc.country, tc.tsp)
+		if w := call(rulesHandler, http.MethodPost, "/rules", body); w.Code != http.StatusCreated {
+			t.Errorf("POST %s: %d %s", tc.key, w.Code, w.Body)
+		}
+		if _, ok := m.get(tc.key); !ok {
+			t.Errorf("POST %s: not stored", tc.key)
+		}
+	}
+	for _, tc := range []struct{ asn, country, tsp string }{
+		{"*", "IR", "irancell"},
+		{"*", "*", "irancell"},
+	} {
+		before := testutil.ToFloat64(ruleRejections.WithLabelValues("unreachable_key"))
+		body := fmt.Sprintf(`{"asn":%q,"country":%q,"tsp":%q,"drop_percent":10,"enabled":true}`, tc.asn, tc.country, tc.tsp)
+		w := call(rulesHandler, http.MethodPost, "/rules", body)
+		if w.Code != http.StatusBadRequest || testutil.ToFloat64(ruleRejections.WithLabelValues("unreachable_key")) != before+1 {
+			t.Errorf("POST %s: %d %s, want 400 unreachable_key", body, w.Code, w.Body)
+		}
+	}
+	m.mu.Lock()
+	keys := m.sortedKeys("rule:*")
+	m.mu.Unlock()
+	if len(keys) != 5 {
+		t.Errorf("stored %q, want only the 5 reachable rules", keys)
+	}
+}
+
+func TestHealthChecksRedis(t *testing.T) {
+	useMemRedis(t)
+	health := func() (int, map[string]any) {
+		t.Helper()
+		w := call(healthHandler, http.MethodGet, "/health", "")
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("/health: %v: %s", err, w.Body)
+		}
+		return w.Code, body
+	}
+	if code, body := health(); code != http.StatusOK || body["ok"] != true || body["redis"] != "ok" {
+		t.Errorf("Redis up: %d %v", code, body)
+	}
+
+	_ = rdb.Close()
+	if code, body := health(); code != http.StatusServiceUnavailable || body["ok"] != false || !strings.Contains(fmt.Sprint(body["redis"]), "closed") {
+		t.Errorf("closed client: %d %v; want 503 with the Redis error", code, body)
+	}
+	if w := call(livezHandler, http.MethodGet, "/livez", ""); w.Code != http.StatusOK {
+		t.Errorf("/livez with Redis gone: %d, want 200", w.Code)
+	}
+}
+
+// MAX_RULES=3 with 2 rules already stored: the third create fits, the
+// fourth is 409, updates never count, and a delete frees a slot.
+func TestMaxRulesBoundary(t *testing.T) {
+	m := useMemRedis(t)
+	resetCap := func() {
+		ruleCap.mu.Lock()
+		ruleCap.n, ruleCap.at = 0, time.Time{} // next create scans
+		ruleCap.mu.Unlock()
+	}
+	maxRules = 3
+	resetCap()
+	t.Cleanup(func() { maxRules = 0; resetCap() })
+	for _, asn := range []string{"AS1", "AS2"} {
+		m.set(rules.Key(Rule{ASN: asn, Country: "IR", TSP: "*"}), fmt.Sprintf(`{"asn":%q,"country":"IR","tsp":"*","enabled":true}`, asn), 0)
+	}
+	rule := func(asn string, pct int) string {
+		return fmt.Sprintf(`{"asn":%q,"country":"IR","tsp":"*","drop_percent":%d,"enabled":true}`, asn, pct)
+	}
+	capped := func(what string, w *httptest.ResponseRecorder, before float64) {
+		t.Helper()
+		if w.Code != http.StatusConflict || testutil.ToFloat64(ruleRejections.WithLabelValues("max_rules")) != before+1 ||
+			!strings.Contains(w.Body.String(), "MAX_RULES=3") {
+			t.Errorf("%s: %d %s, want 409 max_rules", what, w.Code, w.Body)
+		}
+	}
+
+	if w := call(rulesHandler, http.MethodPost, "/rules", rule("AS3", 10)); w.Code != http.StatusCreated {
+		t.Fatalf("3rd rule: %d %s", w.Code, w.Body)
+	}
+	before := testutil.ToFloat64(ruleRejections.WithLabelValues("max_rules"))
+	capped("POST 4th rule", call(rulesHandler, http.MethodPost, "/rules", rule("AS4", 10)), before)
+	capped("PUT 4th rule", call(rulesHandler, http.MethodPut, "/rules", rule("AS4", 10)), before+1)
+	if _, ok := m.get("rule:AS4:IR:*"); ok {
+		t.Error("4th rule stored over the cap")
+	}
+
+	// At the cap, existing rules still change
+	if w := call(rulesHandler, http.MethodPost, "/rules", rule("AS1", 20)); w.Code != http.StatusOK {
+		t.Errorf("POST update at the cap: %d %s", w.Code, w.Body)
+	}
+	if w := call(rulesHandler, http.MethodPut, "/rules", rule("AS2", 20)); w.Code != http.StatusOK {
+		t.Errorf("PUT update at the cap: %d %s", w.Code, w.Body)
+	}
+	if w := call(rulesHandler, http.MethodPatch, "/rules", `{"asn":"AS3","country":"IR","tsp":"*","drop_percent":30}`); w.Code != http.StatusOK {
+		t.Errorf("PATCH at the cap: %d %s", w.Code, w.Body)
+	}
+
+	if w := call(rulesHandler, http.MethodDelete, "/rules?asn=AS1&country=IR&tsp=*", ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if w := call(rulesHandler, http.MethodPost, "/rules", rule("AS4", 10)); w.Code != http.StatusCreated {
+		t.Errorf("POST after a delete: %d %s", w.Code, w.Body)
+	}
+	capped("POST 5th rule", call(rulesHandler, http.MethodPost, "/rules", rule("AS5", 10)), before+2)
+}
@@ -58,6 +58,9 @@ export default async function handler(req: NextApiRequest, res: NextApiResponse)
     const targetURL = `${origin}/${segs.join('/')}${search}`
 
     const headers = sanitizeHeaders(req)
+    // Server-side token for controllers started with API_TOKEN (never sent to the browser)
+    const token = process.env.CONTROLLER_API_TOKEN || ''
+    if (token && !headers.has('authorization')) headers.set('authorization', `Bearer ${token}`)
     const body = await readRawBody(req)
 
     const upstream = await fetch(targetURL, {
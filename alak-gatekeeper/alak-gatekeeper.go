@@ -2,262 +2,1998 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/fnv"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	_ "time/tzdata" // schedule timezones on alpine without tzdata
 
+	"example.com/alak-common/rules"
 	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type Rule struct {
-	ASN         string `json:"asn"`
-	Country     string `json:"country"`
-	TSP         string `json:"tsp"`
-	DropPercent int    `json:"drop_percent"`
-	TTL         int    `json:"ttl"`
-	Enabled     bool   `json:"enabled"`
+var (
+	ctx         = context.Background()
+	redisClient redis.UniversalClient
+
+	// the resolved configuration; set once in main, replaced wholesale by
+	// tests
+	cfg *Config
+
+	// 1 in cfg.GeoSecondaryRate lookups also go to GEO_URL_SECONDARY, at
+	// most cap(geoSecondarySlots) at a time
+	geoSecondarySeq    atomic.Uint64
+	geoSecondarySlots  chan struct{}
+	geoSecondaryClient = &http.Client{Timeout: 2 * time.Second}
+
+	// upstream pool built from cfg.Upstreams, with its health
+	upstreams    []*upstream
+	upstreamNext atomic.Uint64
+	reverseProxy *httputil.ReverseProxy
+
+	// TARPIT_MAX_CONCURRENT slots for requests held by a rule's tarpit_ms;
+	// drops beyond it are answered at once
+	tarpitSlots chan struct{}
+
+	// MAX_CONCURRENT slots for proxied requests (nil = unlimited); WebSocket
+	// upgrades don't take one
+	concurrencySlots chan struct{}
+
+	// METRICS_CARDINALITY=asn: the METRICS_TOP_ASNS ASNs that keep their
+	// label, re-picked every metricASNsInterval from the decayed request
+	// counts in metricASNCounts
+	metricASNsMu    sync.Mutex
+	metricASNs      = map[string]bool{}
+	metricASNCounts = map[string]float64{}
+
+	// deny list from the Redis sets deny:ip and deny:cidr, refreshed every
+	// DENY_REFRESH_INTERVAL and checked before geo
+	denied atomic.Pointer[denyList]
+
+	// kill switch: while the Redis key BYPASS_KEY is "1"/"true", every
+	// request is proxied without geo or rules. Polled, not read per request.
+	bypassActive atomic.Bool
+
+	// LOG_SAMPLE_RATE=N keeps 1 in N [PASS] lines; passSeq picks which
+	passSeq atomic.Uint64
+
+	// cfg.BlockBody gzipped (nil when gzip wouldn't shrink it) and its
+	// sniffed Content-Type
+	blockBodyGzip    []byte
+	blockContentType string
+
+	// ACCESS_LOG_FORMAT=common|combined: one NCSA line per proxied request
+	// to ACCESS_LOG_FILE; nil when off
+	accessLog *log.Logger
+
+	requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_requests_total",
+			Help: "Total incoming requests by ASN, country, and TSP",
+		},
+		[]string{"asn", "country", "tsp"},
+	)
+	drops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_drops_total",
+			Help: "Total dropped requests by ASN, country, and TSP",
+		},
+		[]string{"asn", "country", "tsp"},
+	)
+	proxyProtoErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "alak_proxy_protocol_errors_total",
+			Help: "Connections from trusted PROXY protocol peers closed for a malformed header",
+		},
+	)
+	upstreamHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "alak_upstream_healthy",
+			Help: "1 if the upstream is in rotation, 0 if marked down by a probe or a proxy error",
+		},
+		[]string{"upstream"},
+	)
+	untrustedXFF = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "alak_untrusted_xff_total",
+			Help: "Requests carrying X-Forwarded-For without a valid edge secret (XFF ignored)",
+		},
+	)
+	bogonPassthrough = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "alak_bogon_passthrough_total",
+			Help: "Requests from private/loopback/bogon IPs passed without a geo lookup",
+		},
+	)
+	upstreamSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "alak_upstream_seconds",
+			Help:    "Time from sending a request upstream to its response headers (WebSocket upgrades excluded)",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+	upstreamResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_upstream_responses_total",
+			Help: "Upstream responses by status class (1xx-5xx), or error when the round trip failed",
+		},
+		[]string{"class"},
+	)
+	geoDisagreements = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_geo_disagreement_total",
+			Help: "Sampled lookups where GEO_URL_SECONDARY differed from the primary, by field (asn, country)",
+		},
+		[]string{"field"},
+	)
+	geoCrossChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_geo_crosschecks_total",
+			Help: "Secondary geo cross-checks by result (agree, disagree, not_found, error, skipped)",
+		},
+		[]string{"result"},
+	)
+	denyBlocks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_deny_blocks_total",
+			Help: "Requests blocked by the deny list before any geo lookup, by kind (ip, cidr)",
+		},
+		[]string{"kind"},
+	)
+	denyEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "alak_deny_entries",
+			Help: "Entries in the loaded deny list, by kind (ip, cidr)",
+		},
+		[]string{"kind"},
+	)
+	inflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "alak_inflight_requests",
+			Help: "Requests currently being proxied, by kind (request, long_lived)",
+		},
+		[]string{"kind"},
+	)
+	concurrencyRejections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "alak_concurrency_rejections_total",
+			Help: "Requests answered 503 because MAX_CONCURRENT proxied requests were in flight",
+		},
+	)
+	tarpitActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "alak_tarpit_active",
+			Help: "Dropped requests currently held by a rule's tarpit_ms",
+		},
+	)
+	tarpitOverflow = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "alak_tarpit_overflow_total",
+			Help: "Tarpit drops answered immediately because TARPIT_MAX_CONCURRENT was reached",
+		},
+	)
+	bypassGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "alak_bypass_active",
+			Help: "1 while the BYPASS_KEY kill switch is on and filtering is skipped",
+		},
+	)
+	bypassSeconds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "alak_bypass_seconds_total",
+			Help: "Time spent with the kill switch on",
+		},
+	)
+	bypassRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "alak_bypass_requests_total",
+			Help: "Requests proxied unfiltered because the kill switch was on",
+		},
+	)
+	headerAnomalies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_header_anomalies_total",
+			Help: "Requests with suspicious forwarding headers, by kind (xff_depth, real_ip_mismatch)",
+		},
+		[]string{"kind"},
+	)
+	failClosedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_failclosed_total",
+			Help: "Requests blocked because geo or Redis failed (FAIL_MODE=closed), by reason",
+		},
+		[]string{"reason"},
+	)
+	redisRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_redis_retries_total",
+			Help: "Rule GETs retried after a transient Redis error, by outcome of the retry (ok or error)",
+		},
+		[]string{"result"},
+	)
+	wouldDrops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_would_drop_total",
+			Help: "Requests a shadow rule would have dropped, by ASN, country, and TSP",
+		},
+		[]string{"asn", "country", "tsp"},
+	)
+)
+
+// ctx key to pass SNI (servername) into DialTLSContext
+type sniCtxKey struct{}
+
+// ctx key carrying the *upstream a proxied request was sent to
+type upstreamCtxKey struct{}
+
+// ctx key carrying the client IP proxyHandler resolved, for XFF_MODE
+type clientIPCtxKey struct{}
+
+// ctx key carrying the proxied request's own context into the dialers,
+// see requestBound
+type requestCtxKey struct{}
+
+// ctx key carrying the CancelFunc of an UPSTREAM_REQUEST_TIMEOUT deadline,
+// called by timedTransport once the upstream response is done with
+type deadlineCancelCtxKey struct{}
+
+func init() {
+	prometheus.MustRegister(requests)
+	prometheus.MustRegister(drops)
+	prometheus.MustRegister(wouldDrops)
+	prometheus.MustRegister(untrustedXFF)
+	prometheus.MustRegister(proxyProtoErrors)
+	prometheus.MustRegister(failClosedTotal)
+	prometheus.MustRegister(headerAnomalies)
+	prometheus.MustRegister(upstreamSeconds)
+	prometheus.MustRegister(upstreamResponses)
+	prometheus.MustRegister(geoDisagreements)
+	prometheus.MustRegister(geoCrossChecks)
+	prometheus.MustRegister(denyBlocks)
+	prometheus.MustRegister(denyEntries)
+	prometheus.MustRegister(inflight)
+	prometheus.MustRegister(concurrencyRejections)
+	prometheus.MustRegister(tarpitActive)
+	prometheus.MustRegister(tarpitOverflow)
+	prometheus.MustRegister(bypassGauge)
+	prometheus.MustRegister(bypassSeconds)
+	prometheus.MustRegister(bypassRequests)
+	prometheus.MustRegister(upstreamHealthy)
+	prometheus.MustRegister(bogonPassthrough)
+	prometheus.MustRegister(redisRetries)
+}
+
+// Everything the gatekeeper takes from its env, with defaults applied and
+// checked once by loadConfig. Handlers read it through cfg, so a test can
+// hand them any configuration; /admin/config reports it.
+type Config struct {
+	Port           string
+	AdminPort      string // = Port unless ADMIN_PORT
+	MaxHeaderBytes int
+
+	GeoURL string
+	// GEO_URL_SECONDARY: a second geo service asked for 1 in
+	// GEO_SECONDARY_SAMPLE_RATE lookups, off the hot path, purely to
+	// report where it disagrees with the primary
+	GeoSecondaryURL         string
+	GeoSecondaryRate        uint64
+	GeoSecondaryMaxInflight int
+
+	// upstream pool (HA_PROXY_URLS, else HA_PROXY_URL) and global TLS flags
+	Upstreams     []*url.URL
+	SkipTLSVerify bool
+	SNIOverride   string
+	// UPSTREAM_HOST_ALLOWLIST: lower-cased hostnames requests may be sent
+	// to; defaults to the hosts of the upstream pool
+	UpstreamHostAllow map[string]bool
+	// overall deadline for non-upgrade upstream requests (0 = none)
+	UpstreamTimeout time.Duration
+	// UPSTREAM_STRIP_PREFIX / UPSTREAM_ADD_PREFIX: path prefix removed from,
+	// then prepended to, every proxied request ("" = none, no trailing "/")
+	UpstreamStripPrefix string
+	UpstreamAddPrefix   string
+	Transport           transportConfig
+	ProbeInterval       time.Duration
+	ProbeTimeout        time.Duration
+	// request body cap for non-upgrade requests (0 = unlimited)
+	MaxBodyBytes int64
+
+	RedisMode string
+	Redis     *redis.UniversalOptions
+	// extra rule GETs after a transient Redis error, and the first pause
+	// between them (doubled each retry) before failing open/closed
+	RedisLookupRetries int
+	RedisRetryBackoff  time.Duration
+
+	// shared with the edge; when set, XFF is only trusted alongside X-Alak-Edge
+	EdgeSecret string
+	// PROXY_PROTOCOL=true: peers in these CIDRs may prefix connections with
+	// a PROXY v1/v2 header carrying the real client address
+	ProxyProtoTrusted []*net.IPNet
+	// inbound headers dropped before anything reads them (STRIP_HEADERS):
+	// exact names, or prefixes from "X-Foo-*" entries, lower-cased
+	StripExact    map[string]bool
+	StripPrefixes []string
+	// forwarding-header anomaly policy: XFF chains longer than XFFMaxDepth
+	// (0 = no limit), X-Real-IP absent from the chain (XFF_REAL_IP_CHECK);
+	// counted and logged, and blocked with HEADER_ANOMALY_ACTION=block
+	XFFMaxDepth    int
+	XFFRealIPCheck bool
+	AnomalyBlock   bool
+	// XFF_MODE: what the upstream sees as the client (append, replace, real-ip)
+	XFFMode string
+	// MISSING_IP_POLICY: what to do when neither XFF nor the socket yields a
+	// client IP (reject, pass, use-remote)
+	MissingIPPolicy string
+	// sources that never have geo data (BOGON_CIDRS); passed without a lookup
+	BogonNets []*net.IPNet
+
+	MaxConcurrent int // 0 = unlimited
+	TarpitMax     int
+	// 0 = deny list off
+	DenyRefresh time.Duration
+	// Redis key of the kill switch ("none" = not polled), read every BypassCheck
+	BypassKey   string
+	BypassCheck time.Duration
+	// FAIL_MODE=closed blocks instead of proxying on geo/Redis errors
+	FailClosed bool
+	// default timezone for rule schedules (ALAK_SCHEDULE_TZ)
+	ScheduleTZ *time.Location
+	// UA_RULES=true adds the client's User-Agent class to rule lookups,
+	// doubling the keys checked per request
+	UARules bool
+
+	// GATEKEEPER_DEBUG=false drops the per-request [DEBUG]/[PASS] lines
+	VerboseLog    bool
+	LogSampleRate uint64
+	// off, common or combined, written to AccessLogFile ("-" = stdout)
+	AccessLogFormat string
+	AccessLogFile   string
+	// DEBUG_HEADERS=true surfaces the decision as X-Alak-* response headers
+	DebugHeaders bool
+	// 403 block page: BLOCK_BODY_FILE's contents, or the default text
+	BlockBodyFile string
+	BlockBody     []byte
+	// METRICS_CARDINALITY: labels on the per-request counters (detailed,
+	// country, asn). In asn mode the MetricsTopASNs busiest ASNs keep
+	// their label and the rest count as "other".
+	MetricsCardinality string
+	MetricsTopASNs     int
+	// ADMIN_TOKEN enables GET /admin/explain and /admin/config (Bearer
+	// auth); unset = no endpoints
+	AdminToken string
+}
+
+// Reads and validates the env, reporting every invalid setting at once.
+// Nothing is started or opened here except reading BLOCK_BODY_FILE.
+func loadConfig() (*Config, error) {
+	var errs []error
+	bad := func(format string, args ...any) { errs = append(errs, fmt.Errorf(format, args...)) }
+	envInt := func(k string, def int) int {
+		n, err := getenvInt(k, def)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return n
+	}
+	envDuration := func(k string, def time.Duration) time.Duration {
+		d, err := getenvDuration(k, def)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return d
+	}
+	envPrefix := func(k string) string {
+		p, err := pathPrefixEnv(k)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return p
+	}
+	envCIDRs := func(k, v string) []*net.IPNet {
+		nets, err := parseCIDRs(k, v)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return nets
+	}
+
+	c := &Config{
+		Port:            getenv("PORT", "8090"),
+		GeoURL:          getenv("ALAK_GEO_URL", "http://alak-geo:8081/lookup"),
+		GeoSecondaryURL: getenv("GEO_URL_SECONDARY", ""),
+		SkipTLSVerify:   strings.EqualFold(getenv("SKIP_TLS_VERIFY", "true"), "true"),
+		SNIOverride:     getenv("ALAK_SNI_OVERRIDE", ""),
+		ScheduleTZ:      time.UTC,
+	}
+	c.AdminPort = getenv("ADMIN_PORT", c.Port)
+	c.MaxHeaderBytes = envInt("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+
+	if c.GeoSecondaryURL != "" {
+		rate := envInt("GEO_SECONDARY_SAMPLE_RATE", 100)
+		if rate < 1 {
+			bad("invalid GEO_SECONDARY_SAMPLE_RATE %d (want >= 1)", rate)
+		}
+		c.GeoSecondaryRate = uint64(max(rate, 1))
+		if c.GeoSecondaryMaxInflight = envInt("GEO_SECONDARY_MAX_INFLIGHT", 16); c.GeoSecondaryMaxInflight < 1 {
+			bad("invalid GEO_SECONDARY_MAX_INFLIGHT %d (want >= 1)", c.GeoSecondaryMaxInflight)
+		}
+	}
+
+	upstreamsEnv, upstreamsVar := getenv("HA_PROXY_URLS", ""), "HA_PROXY_URLS"
+	if upstreamsEnv == "" {
+		upstreamsEnv, upstreamsVar = getenv("HA_PROXY_URL", "http://haproxy:80"), "HA_PROXY_URL"
+	}
+	for _, raw := range strings.Split(upstreamsEnv, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			bad("invalid %s entry %q: %v", upstreamsVar, raw, err)
+			continue
+		}
+		c.Upstreams = append(c.Upstreams, u)
+	}
+	if len(c.Upstreams) == 0 {
+		bad("%s is empty", upstreamsVar)
+	}
+	c.UpstreamHostAllow = map[string]bool{}
+	if v := getenv("UPSTREAM_HOST_ALLOWLIST", ""); v != "" {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.ToLower(hostNoPort(strings.TrimSpace(h))); h != "" {
+				c.UpstreamHostAllow[h] = true
+			}
+		}
+		for _, u := range c.Upstreams {
+			if !c.UpstreamHostAllow[strings.ToLower(u.Hostname())] {
+				bad("%s host %q is not in UPSTREAM_HOST_ALLOWLIST", upstreamsVar, u.Hostname())
+			}
+		}
+		if h := strings.ToLower(c.SNIOverride); h != "" && !c.UpstreamHostAllow[h] {
+			bad("ALAK_SNI_OVERRIDE %q is not in UPSTREAM_HOST_ALLOWLIST", c.SNIOverride)
+		}
+	} else {
+		for _, u := range c.Upstreams {
+			c.UpstreamHostAllow[strings.ToLower(u.Hostname())] = true
+		}
+		if c.SNIOverride != "" {
+			c.UpstreamHostAllow[strings.ToLower(c.SNIOverride)] = true
+		}
+	}
+
+	if tz := getenv("ALAK_SCHEDULE_TZ", ""); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			bad("invalid ALAK_SCHEDULE_TZ %q: %v", tz, err)
+		} else {
+			c.ScheduleTZ = loc
+		}
+	}
+
+	c.RedisMode = getenv("REDIS_MODE", "single")
+	switch strings.ToLower(c.RedisMode) {
+	case "", "single", "sentinel", "cluster":
+	default:
+		bad("invalid REDIS_MODE %q (want single, sentinel or cluster)", c.RedisMode)
+	}
+	c.Redis = &redis.UniversalOptions{
+		Addrs:      redisAddrs(getenv("REDIS_HOST", "localhost:6379")),
+		MasterName: getenv("REDIS_MASTER_NAME", ""),
+		Password:   getenv("REDIS_PASSWORD", ""),
+		DB:         envInt("REDIS_DB", 0),
+		// Hot-path defaults: fail fast so a Redis blip costs milliseconds,
+		// not seconds, before we fail open.
+		PoolSize:     envInt("REDIS_POOL_SIZE", 10*runtime.GOMAXPROCS(0)),
+		DialTimeout:  envDuration("REDIS_DIAL_TIMEOUT", 500*time.Millisecond),
+		ReadTimeout:  envDuration("REDIS_READ_TIMEOUT", 200*time.Millisecond),
+		WriteTimeout: envDuration("REDIS_WRITE_TIMEOUT", 200*time.Millisecond),
+		MaxRetries:   envInt("REDIS_MAX_RETRIES", 1),
+	}
+	if strings.EqualFold(c.RedisMode, "sentinel") && c.Redis.MasterName == "" {
+		bad("REDIS_MODE=sentinel requires REDIS_MASTER_NAME")
+	}
+	c.RedisLookupRetries = envInt("REDIS_LOOKUP_RETRIES", 2)
+	c.RedisRetryBackoff = envDuration("REDIS_RETRY_BACKOFF", 10*time.Millisecond)
+
+	c.UpstreamTimeout = envDuration("UPSTREAM_REQUEST_TIMEOUT", 0)
+	c.UpstreamStripPrefix = envPrefix("UPSTREAM_STRIP_PREFIX")
+	c.UpstreamAddPrefix = envPrefix("UPSTREAM_ADD_PREFIX")
+	c.MaxBodyBytes = int64(envInt("MAX_BODY_BYTES", 0))
+
+	if v := getenv("BOGON_CIDRS", defaultBogonCIDRs); !strings.EqualFold(v, "none") {
+		c.BogonNets = envCIDRs("BOGON_CIDRS", v)
+	}
+
+	switch mode := strings.ToLower(getenv("FAIL_MODE", "open")); mode {
+	case "open":
+	case "closed":
+		c.FailClosed = true
+	default:
+		bad("invalid FAIL_MODE %q (want open or closed)", mode)
+	}
+
+	c.VerboseLog = !strings.EqualFold(getenv("GATEKEEPER_DEBUG", "true"), "false")
+	sampleRate := envInt("LOG_SAMPLE_RATE", 1)
+	if sampleRate < 1 {
+		bad("invalid LOG_SAMPLE_RATE %d (want >= 1)", sampleRate)
+	}
+	c.LogSampleRate = uint64(max(sampleRate, 1))
+	c.BlockBody = []byte("Request blocked by Alak Gatekeeper\n")
+	if c.BlockBodyFile = getenv("BLOCK_BODY_FILE", ""); c.BlockBodyFile != "" {
+		b, err := os.ReadFile(c.BlockBodyFile)
+		if err != nil {
+			bad("BLOCK_BODY_FILE: %v", err)
+		}
+		c.BlockBody = b
+	}
+
+	c.DebugHeaders = strings.EqualFold(getenv("DEBUG_HEADERS", "false"), "true")
+	c.UARules = strings.EqualFold(getenv("UA_RULES", "false"), "true")
+
+	c.StripExact = map[string]bool{}
+	if v := getenv("STRIP_HEADERS", "X-Alak-*"); !strings.EqualFold(v, "none") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h == "" {
+				continue
+			}
+			if p, ok := strings.CutSuffix(h, "*"); ok {
+				c.StripPrefixes = append(c.StripPrefixes, strings.ToLower(p))
+			} else {
+				c.StripExact[strings.ToLower(h)] = true
+			}
+		}
+	}
+
+	switch c.AccessLogFormat = strings.ToLower(getenv("ACCESS_LOG_FORMAT", "off")); c.AccessLogFormat {
+	case "off":
+	case "common", "combined":
+		c.AccessLogFile = getenv("ACCESS_LOG_FILE", "-")
+	default:
+		bad("invalid ACCESS_LOG_FORMAT %q (want off, common or combined)", c.AccessLogFormat)
+	}
+
+	c.XFFMaxDepth = envInt("XFF_MAX_DEPTH", 0)
+	c.XFFRealIPCheck = strings.EqualFold(getenv("XFF_REAL_IP_CHECK", "false"), "true")
+	switch action := strings.ToLower(getenv("HEADER_ANOMALY_ACTION", "log")); action {
+	case "log":
+	case "block":
+		c.AnomalyBlock = true
+	default:
+		bad("invalid HEADER_ANOMALY_ACTION %q (want log or block)", action)
+	}
+
+	switch c.MissingIPPolicy = strings.ToLower(getenv("MISSING_IP_POLICY", "use-remote")); c.MissingIPPolicy {
+	case "reject", "pass", "use-remote":
+	default:
+		bad("invalid MISSING_IP_POLICY %q (want reject, pass or use-remote)", c.MissingIPPolicy)
+	}
+
+	c.EdgeSecret = getenv("EDGE_SECRET", "")
+
+	if strings.EqualFold(getenv("PROXY_PROTOCOL", "false"), "true") {
+		c.ProxyProtoTrusted = envCIDRs("PROXY_PROTOCOL_TRUSTED_CIDRS", getenv("PROXY_PROTOCOL_TRUSTED_CIDRS", ""))
+		if len(c.ProxyProtoTrusted) == 0 {
+			bad("PROXY_PROTOCOL=true requires PROXY_PROTOCOL_TRUSTED_CIDRS")
+		}
+	}
+
+	c.Transport = transportConfig{
+		dialTimeout:         envDuration("UPSTREAM_DIAL_TIMEOUT", 15*time.Second),
+		tlsHandshakeTimeout: envDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", 15*time.Second),
+		respHeaderTimeout:   envDuration("UPSTREAM_RESP_HEADER_TIMEOUT", 15*time.Second),
+		idleTimeout:         envDuration("UPSTREAM_IDLE_TIMEOUT", 120*time.Second),
+		maxIdleConns:        envInt("UPSTREAM_MAX_IDLE_CONNS", 512),
+	}
+	for _, t := range []struct {
+		k string
+		d time.Duration
+	}{
+		{"UPSTREAM_DIAL_TIMEOUT", c.Transport.dialTimeout},
+		{"UPSTREAM_TLS_HANDSHAKE_TIMEOUT", c.Transport.tlsHandshakeTimeout},
+		{"UPSTREAM_RESP_HEADER_TIMEOUT", c.Transport.respHeaderTimeout},
+		{"UPSTREAM_IDLE_TIMEOUT", c.Transport.idleTimeout},
+	} {
+		if t.d <= 0 {
+			bad("invalid %s %s (want > 0)", t.k, t.d)
+		}
+	}
+	if c.Transport.maxIdleConns < 0 {
+		bad("invalid UPSTREAM_MAX_IDLE_CONNS %d (want >= 0; 0 = unlimited)", c.Transport.maxIdleConns)
+	}
+	c.ProbeInterval = envDuration("UPSTREAM_PROBE_INTERVAL", 5*time.Second)
+	c.ProbeTimeout = envDuration("UPSTREAM_PROBE_TIMEOUT", 2*time.Second)
+
+	switch c.XFFMode = strings.ToLower(getenv("XFF_MODE", "append")); c.XFFMode {
+	case "append", "replace", "real-ip":
+	default:
+		bad("invalid XFF_MODE %q (want append, replace or real-ip)", c.XFFMode)
+	}
+
+	switch c.MetricsCardinality = strings.ToLower(getenv("METRICS_CARDINALITY", "detailed")); c.MetricsCardinality {
+	case "detailed", "country":
+	case "asn":
+		if c.MetricsTopASNs = envInt("METRICS_TOP_ASNS", 100); c.MetricsTopASNs < 1 {
+			bad("invalid METRICS_TOP_ASNS %d (want >= 1)", c.MetricsTopASNs)
+		}
+	default:
+		bad("invalid METRICS_CARDINALITY %q (want detailed, country or asn)", c.MetricsCardinality)
+	}
+
+	if c.MaxConcurrent = envInt("MAX_CONCURRENT", 0); c.MaxConcurrent < 0 {
+		bad("invalid MAX_CONCURRENT %d (want >= 0)", c.MaxConcurrent)
+	}
+	if c.TarpitMax = envInt("TARPIT_MAX_CONCURRENT", 256); c.TarpitMax < 0 {
+		bad("invalid TARPIT_MAX_CONCURRENT %d (want >= 0)", c.TarpitMax)
+	}
+
+	c.DenyRefresh = envDuration("DENY_REFRESH_INTERVAL", 5*time.Second)
+	if c.BypassKey = getenv("BYPASS_KEY", "alak:bypass"); !strings.EqualFold(c.BypassKey, "none") {
+		c.BypassCheck = envDuration("BYPASS_CHECK_INTERVAL", 2*time.Second)
+	}
+
+	// The admin endpoints never share the public port: on it they'd be one
+	// leaked token away from anyone the edge lets through
+	if c.AdminToken = getenv("ADMIN_TOKEN", ""); c.AdminToken != "" && c.AdminPort == c.Port {
+		bad("ADMIN_TOKEN requires an ADMIN_PORT other than PORT %s", c.Port)
+	}
+	return c, errors.Join(errs...)
+}
+
+func main() {
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	cfg = c
+
+	if c.GeoSecondaryURL != "" {
+		geoSecondarySlots = make(chan struct{}, c.GeoSecondaryMaxInflight)
+		log.Printf("Geo cross-check: 1 in %d lookups also sent to %s", c.GeoSecondaryRate, c.GeoSecondaryURL)
+	}
+	for _, u := range c.Upstreams {
+		up := &upstream{url: u}
+		up.setHealthy(true)
+		upstreams = append(upstreams, up)
+	}
+
+	redisClient = newRedisClient(c.RedisMode, c.Redis)
+
+	if c.SkipTLSVerify {
+		log.Printf("⚠️  SKIP_TLS_VERIFY=true — backend TLS certificate verification is disabled.")
+	}
+	if c.UpstreamStripPrefix != "" || c.UpstreamAddPrefix != "" {
+		log.Printf("Upstream path rewrite: strip %q, add %q", c.UpstreamStripPrefix, c.UpstreamAddPrefix)
+	}
+	if c.FailClosed {
+		log.Printf("⚠️  FAIL_MODE=closed — requests are blocked while geo or Redis is failing.")
+	}
+
+	setBlockBody(c.BlockBody)
+
+	if c.DebugHeaders {
+		log.Printf("⚠️  DEBUG_HEADERS=true — decisions and geo data are exposed in response headers.")
+	}
+
+	if c.AccessLogFormat != "off" {
+		sink := os.Stdout
+		if path := c.AccessLogFile; path != "-" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				log.Fatalf("ACCESS_LOG_FILE: %v", err)
+			}
+			sink = f
+		}
+		accessLog = log.New(sink, "", 0)
+	}
+
+	if c.EdgeSecret == "" {
+		log.Printf("⚠️  EDGE_SECRET not set — X-Forwarded-For is trusted from any client.")
+	}
+
+	tc := c.Transport
+	log.Printf("Upstream transport: dial=%s tls_handshake=%s response_header=%s idle=%s max_idle_conns=%d",
+		tc.dialTimeout, tc.tlsHandshakeTimeout, tc.respHeaderTimeout, tc.idleTimeout, tc.maxIdleConns)
+
+	transport := newUpstreamTransport(c)
+	reverseProxy = newReverseProxy(c, transport)
+	go probeUpstreams(c.ProbeInterval, c.ProbeTimeout)
+
+	if c.MaxConcurrent > 0 {
+		concurrencySlots = make(chan struct{}, c.MaxConcurrent)
+	}
+	tarpitSlots = make(chan struct{}, c.TarpitMax)
+
+	if c.MetricsCardinality == "asn" {
+		go reselectMetricASNsEvery(metricASNsInterval)
+	}
+	if c.DenyRefresh > 0 {
+		go refreshDenyList(c.DenyRefresh)
+	}
+	if !strings.EqualFold(c.BypassKey, "none") {
+		go pollBypass(c.BypassCheck)
+	}
+
+	// With ADMIN_PORT set, /metrics, /healthz and /readyz live on their own
+	// listener and the main port does nothing but proxy.
+	mainMux := http.NewServeMux()
+	if accessLog != nil {
+		mainMux.HandleFunc("/", withAccessLog(proxyHandler))
+	} else {
+		mainMux.HandleFunc("/", proxyHandler)
+	}
+	adminMux := mainMux
+	if c.AdminPort != c.Port {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.HandleFunc("/healthz", healthzHandler)
+	adminMux.HandleFunc("/readyz", readyzHandler)
+	adminMux.Handle("/metrics", promhttp.Handler())
+	if c.AdminToken != "" && c.AdminPort != c.Port {
+		adminMux.HandleFunc("/admin/explain", explainHandler)
+		adminMux.HandleFunc("/admin/config", configHandler)
+	}
+
+	if c.AdminPort != c.Port {
+		go func() {
+			log.Printf("Alak Gatekeeper admin listening on :%s", c.AdminPort)
+			log.Fatal(http.ListenAndServe(":"+c.AdminPort, adminMux))
+		}()
+	}
+
+	ln, err := net.Listen("tcp", ":"+c.Port)
+	if err != nil {
+		log.Fatalf("listen :%s: %v", c.Port, err)
+	}
+	if len(c.ProxyProtoTrusted) > 0 {
+		ln = &proxyProtoListener{Listener: ln, trusted: c.ProxyProtoTrusted}
+	}
+
+	var ups []string
+	for _, u := range c.Upstreams {
+		ups = append(ups, u.Redacted())
+	}
+	log.Printf("Alak Gatekeeper listening on :%s (upstreams=%s, geo=%s, skip_verify=%v, sni_override=%q, proxy_protocol=%v)",
+		c.Port, strings.Join(ups, ","), c.GeoURL, c.SkipTLSVerify, c.SNIOverride, len(c.ProxyProtoTrusted) > 0)
+	srv := &http.Server{
+		Handler:        mainMux,
+		MaxHeaderBytes: c.MaxHeaderBytes,
+	}
+	log.Fatal(srv.Serve(ln))
+}
+
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Ready when Redis answers. Gatekeeper still fails open without it; this
+// only lets an orchestrator route around an instance that lost Redis.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	pingCtx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	if err := redisClient.Ping(pingCtx).Err(); err != nil {
+		http.Error(w, "redis not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Checks the ADMIN_TOKEN bearer token, answering 401 when it doesn't match.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(cfg.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="alak-gatekeeper"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Effective configuration as GET /admin/config reports it: cfg, which the
+// handlers read too, with durations as strings and secrets redacted.
+type configView struct {
+	Port           string `json:"port"`
+	AdminPort      string `json:"admin_port"`
+	MaxHeaderBytes int    `json:"max_header_bytes"`
+
+	Upstreams              []string `json:"upstreams"`
+	UpstreamHostAllowlist  []string `json:"upstream_host_allowlist"`
+	UpstreamStripPrefix    string   `json:"upstream_strip_prefix"`
+	UpstreamAddPrefix      string   `json:"upstream_add_prefix"`
+	UpstreamRequestTimeout string   `json:"upstream_request_timeout"`
+	UpstreamDialTimeout    string   `json:"upstream_dial_timeout"`
+	UpstreamTLSHandshake   string   `json:"upstream_tls_handshake_timeout"`
+	UpstreamRespHeader     string   `json:"upstream_resp_header_timeout"`
+	UpstreamIdleTimeout    string   `json:"upstream_idle_timeout"`
+	UpstreamMaxIdleConns   int      `json:"upstream_max_idle_conns"`
+	UpstreamProbeInterval  string   `json:"upstream_probe_interval"`
+	UpstreamProbeTimeout   string   `json:"upstream_probe_timeout"`
+	SkipTLSVerify          bool     `json:"skip_tls_verify"`
+	SNIOverride            string   `json:"sni_override"`
+	MaxBodyBytes           int64    `json:"max_body_bytes"`
+
+	GeoURL                  string `json:"geo_url"`
+	GeoSecondaryURL         string `json:"geo_secondary_url"`
+	GeoSecondarySampleRate  uint64 `json:"geo_secondary_sample_rate,omitempty"`
+	GeoSecondaryMaxInflight int    `json:"geo_secondary_max_inflight,omitempty"`
+
+	RedisMode          string   `json:"redis_mode"`
+	RedisAddrs         []string `json:"redis_addrs"`
+	RedisMasterName    string   `json:"redis_master_name"`
+	RedisPassword      string   `json:"redis_password"`
+	RedisDB            int      `json:"redis_db"`
+	RedisPoolSize      int      `json:"redis_pool_size"`
+	RedisDialTimeout   string   `json:"redis_dial_timeout"`
+	RedisReadTimeout   string   `json:"redis_read_timeout"`
+	RedisWriteTimeout  string   `json:"redis_write_timeout"`
+	RedisMaxRetries    int      `json:"redis_max_retries"`
+	RedisLookupRetries int      `json:"redis_lookup_retries"`
+	RedisRetryBackoff  string   `json:"redis_retry_backoff"`
+
+	FailMode            string   `json:"fail_mode"`
+	MissingIPPolicy     string   `json:"missing_ip_policy"`
+	XFFMode             string   `json:"xff_mode"`
+	XFFMaxDepth         int      `json:"xff_max_depth"`
+	XFFRealIPCheck      bool     `json:"xff_real_ip_check"`
+	HeaderAnomalyAction string   `json:"header_anomaly_action"`
+	EdgeSecret          string   `json:"edge_secret"`
+	ProxyProtocolCIDRs  []string `json:"proxy_protocol_trusted_cidrs"`
+	StripHeaders        []string `json:"strip_headers"`
+	BogonCIDRs          []string `json:"bogon_cidrs"`
+
+	MaxConcurrent       int    `json:"max_concurrent"`
+	TarpitMaxConcurrent int    `json:"tarpit_max_concurrent"`
+	DenyRefreshInterval string `json:"deny_refresh_interval"`
+	BypassKey           string `json:"bypass_key"`
+	BypassCheckInterval string `json:"bypass_check_interval"`
+	ScheduleTZ          string `json:"schedule_tz"`
+	UARules             bool   `json:"ua_rules"`
+
+	GatekeeperDebug    bool   `json:"gatekeeper_debug"`
+	LogSampleRate      uint64 `json:"log_sample_rate"`
+	AccessLogFormat    string `json:"access_log_format"`
+	AccessLogFile      string `json:"access_log_file"`
+	DebugHeaders       bool   `json:"debug_headers"`
+	BlockBodyFile      string `json:"block_body_file"`
+	MetricsCardinality string `json:"metrics_cardinality"`
+	MetricsTopASNs     int    `json:"metrics_top_asns,omitempty"`
+	AdminToken         string `json:"admin_token"`
+}
+
+func currentConfig() configView {
+	c := cfg
+	v := configView{
+		Port:                   c.Port,
+		AdminPort:              c.AdminPort,
+		MaxHeaderBytes:         c.MaxHeaderBytes,
+		UpstreamStripPrefix:    c.UpstreamStripPrefix,
+		UpstreamAddPrefix:      c.UpstreamAddPrefix,
+		UpstreamRequestTimeout: c.UpstreamTimeout.String(),
+		UpstreamDialTimeout:    c.Transport.dialTimeout.String(),
+		UpstreamTLSHandshake:   c.Transport.tlsHandshakeTimeout.String(),
+		UpstreamRespHeader:     c.Transport.respHeaderTimeout.String(),
+		UpstreamIdleTimeout:    c.Transport.idleTimeout.String(),
+		UpstreamMaxIdleConns:   c.Transport.maxIdleConns,
+		UpstreamProbeInterval:  c.ProbeInterval.String(),
+		UpstreamProbeTimeout:   c.ProbeTimeout.String(),
+		SkipTLSVerify:          c.SkipTLSVerify,
+		SNIOverride:            c.SNIOverride,
+		MaxBodyBytes:           c.MaxBodyBytes,
+
+		GeoURL:                  redactURL(c.GeoURL),
+		GeoSecondaryURL:         redactURL(c.GeoSecondaryURL),
+		GeoSecondarySampleRate:  c.GeoSecondaryRate,
+		GeoSecondaryMaxInflight: c.GeoSecondaryMaxInflight,
+
+		RedisMode:          c.RedisMode,
+		RedisAddrs:         c.Redis.Addrs,
+		RedisMasterName:    c.Redis.MasterName,
+		RedisPassword:      redact(c.Redis.Password),
+		RedisDB:            c.Redis.DB,
+		RedisPoolSize:      c.Redis.PoolSize,
+		RedisDialTimeout:   c.Redis.DialTimeout.String(),
+		RedisReadTimeout:   c.Redis.ReadTimeout.String(),
+		RedisWriteTimeout:  c.Redis.WriteTimeout.String(),
+		RedisMaxRetries:    c.Redis.MaxRetries,
+		RedisLookupRetries: c.RedisLookupRetries,
+		RedisRetryBackoff:  c.RedisRetryBackoff.String(),
+
+		FailMode:            "open",
+		MissingIPPolicy:     c.MissingIPPolicy,
+		XFFMode:             c.XFFMode,
+		XFFMaxDepth:         c.XFFMaxDepth,
+		XFFRealIPCheck:      c.XFFRealIPCheck,
+		HeaderAnomalyAction: "log",
+		EdgeSecret:          redact(c.EdgeSecret),
+		ProxyProtocolCIDRs:  netStrings(c.ProxyProtoTrusted),
+		BogonCIDRs:          netStrings(c.BogonNets),
+
+		MaxConcurrent:       c.MaxConcurrent,
+		TarpitMaxConcurrent: c.TarpitMax,
+		DenyRefreshInterval: c.DenyRefresh.String(),
+		BypassKey:           c.BypassKey,
+		BypassCheckInterval: c.BypassCheck.String(),
+		ScheduleTZ:          c.ScheduleTZ.String(),
+		UARules:             c.UARules,
+
+		GatekeeperDebug:    c.VerboseLog,
+		LogSampleRate:      c.LogSampleRate,
+		AccessLogFormat:    c.AccessLogFormat,
+		AccessLogFile:      c.AccessLogFile,
+		DebugHeaders:       c.DebugHeaders,
+		BlockBodyFile:      c.BlockBodyFile,
+		MetricsCardinality: c.MetricsCardinality,
+		MetricsTopASNs:     c.MetricsTopASNs,
+		AdminToken:         redact(c.AdminToken),
+	}
+	for _, u := range c.Upstreams {
+		v.Upstreams = append(v.Upstreams, u.Redacted())
+	}
+	for h := range c.UpstreamHostAllow {
+		v.UpstreamHostAllowlist = append(v.UpstreamHostAllowlist, h)
+	}
+	slices.Sort(v.UpstreamHostAllowlist)
+	if c.FailClosed {
+		v.FailMode = "closed"
+	}
+	if c.AnomalyBlock {
+		v.HeaderAnomalyAction = "block"
+	}
+	for h := range c.StripExact {
+		v.StripHeaders = append(v.StripHeaders, h)
+	}
+	slices.Sort(v.StripHeaders)
+	for _, p := range c.StripPrefixes {
+		v.StripHeaders = append(v.StripHeaders, p+"*")
+	}
+	return v
+}
+
+// "[redacted]" for a set secret, "" for an unset one
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// raw with any userinfo password masked
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redact(raw)
+	}
+	return u.Redacted()
+}
+
+func netStrings(nets []*net.IPNet) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	return out
+}
+
+// GET /admin/config: the effective configuration, secrets redacted.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(currentConfig())
+}
+
+// GET /admin/explain?ip=[&ua=]: what proxyHandler would decide for that
+// client (sending that User-Agent, with UA_RULES), through the same
+// bypass/deny checks and classify, without proxying or counting anything.
+// Header checks are per request and not covered.
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := strings.TrimSpace(r.URL.Query().Get("ip"))
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "ip must be a valid IP address", http.StatusBadRequest)
+		return
+	}
+
+	var v verdict
+	switch kind := denied.Load().match(ip); {
+	case bypassActive.Load():
+		v = verdict{IP: ip, Hash: rules.HashIP(ip), HashPerMille: rules.HashIPPerMille(ip), Decision: "bypass", Reason: "bypass"}
+	case kind != "":
+		v = verdict{IP: ip, Hash: rules.HashIP(ip), HashPerMille: rules.HashIPPerMille(ip), Decision: "deny", Reason: "deny:" + kind}
+	default:
+		var err error
+		uaClass := ""
+		if cfg.UARules {
+			uaClass = rules.ClassifyUA(r.URL.Query().Get("ua"))
+		}
+		if v, err = classify(r.Context(), ip, uaClass); err != nil {
+			v.Decision, v.Reason, v.Error = "pass", err.(*lookupError).reason+"_error", err.Error()
+			if cfg.FailClosed {
+				v.Decision = "fail-closed"
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	stripHeaders(r.Header)
+
+	// Bodies past MAX_BODY_BYTES: refuse up front when Content-Length says
+	// so, else the capped reader fails mid-stream and ErrorHandler sends 413.
+	// Only real upgrades are exempt: Accept: text/event-stream is the
+	// client's to set, and SSE requests carry no large bodies anyway.
+	if cfg.MaxBodyBytes > 0 && !isUpgrade(r) {
+		if r.ContentLength > cfg.MaxBodyBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+	}
+
+	// --- Client IP extraction (prefer XFF set by edge HAProxy) ---
+	ip := clientIP(r)
+	if ip == "" && cfg.MissingIPPolicy == "use-remote" {
+		// RemoteAddr without a port (some listeners, unix sockets) didn't
+		// split; take it whole if it is an address at all
+		if h := hostNoPort(r.RemoteAddr); net.ParseIP(h) != nil {
+			log.Printf("[WARN] No client IP in X-Forwarded-For; using RemoteAddr %s", h)
+			ip = h
+		}
+	}
+	if ip == "" {
+		if cfg.MissingIPPolicy == "reject" {
+			log.Printf("[ERROR] No client IP found in request")
+			http.Error(w, "Missing X-Forwarded-For header", http.StatusBadRequest)
+			return
+		}
+		log.Printf("[WARN] No client IP found in request (RemoteAddr %q); proxying without a geo lookup", r.RemoteAddr)
+		decide(w, "pass")
+		forward(w, r)
+		return
+	}
+	if rec, ok := w.(*accessRecorder); ok {
+		rec.client = ip
+	}
+	r = r.WithContext(context.WithValue(r.Context(), clientIPCtxKey{}, ip))
+	decide(w, "pass") // overwritten on drop
+
+	if bypassActive.Load() {
+		bypassRequests.Inc()
+		decide(w, "bypass")
+		passf("[PASS] Bypass on (%s); IP %s not filtered", cfg.BypassKey, ip)
+		forward(w, r)
+		return
+	}
+
+	if kind := headerAnomaly(r); kind != "" {
+		headerAnomalies.WithLabelValues(kind).Inc()
+		msg := fmt.Sprintf("[ANOMALY] %s from %s (XFF=%q X-Real-IP=%q)", kind, r.RemoteAddr, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Real-Ip"))
+		if cfg.AnomalyBlock {
+			log.Print(msg + "; blocking request")
+			decide(w, "anomaly")
+			block(w, r)
+			return
+		}
+		log.Print(msg)
+	}
+
+	if kind := denied.Load().match(ip); kind != "" {
+		denyBlocks.WithLabelValues(kind).Inc()
+		log.Printf("[DENY] IP %s is on deny:%s; blocking request", ip, kind)
+		decide(w, "deny")
+		block(w, r)
+		return
+	}
+
+	uaClass := ""
+	if cfg.UARules {
+		uaClass = rules.ClassifyUA(r.UserAgent())
+		setDebug(w, "X-Alak-UA-Class", uaClass)
+	}
+	v, err := classify(r.Context(), ip, uaClass)
+	var labels prometheus.Labels
+	if v.Meta != nil {
+		meta := *v.Meta
+		crossCheckGeo(ip, meta)
+		labels = metricLabels(meta)
+		requests.With(labels).Inc()
+		setDebug(w, "X-Alak-ASN", meta.ASN)
+		setDebug(w, "X-Alak-Country", meta.Country)
+		setDebug(w, "X-Alak-TSP", meta.TSP)
+		setDebug(w, "X-Alak-Hash", strconv.Itoa(v.Hash))
+
+		if meta.Country == "" && meta.ASN != "" {
+			log.Printf("[DEGRADED] No country for IP=%s ASN=%q; country-scoped rules skipped, ASN and global rules still apply", ip, meta.ASN)
+		}
+		debugf("[DEBUG] IP=%s ASN=%q Country=%q TSP=%q City=%q UA=%q; Keys checked: %v", ip, meta.ASN, meta.Country, meta.TSP, meta.City, meta.UAClass, v.KeysChecked)
+	}
+	var le *lookupError
+	if errors.As(err, &le) {
+		onLookupError(w, r, le.reason, "%s", le.msg)
+		return
+	}
+
+	switch v.Reason {
+	case "bogon":
+		bogonPassthrough.Inc()
+		passf("[PASS] Bogon source IP %s; skipping geo lookup", ip)
+		forward(w, r)
+		return
+	case "no_geo_data":
+		passf("[PASS] No GeoIP data for IP %s", ip)
+		forward(w, r)
+		return
+	case "no_rule":
+		passf("[PASS] No matching rule for IP=%s ASN=%q Country=%q TSP=%q", ip, v.Meta.ASN, v.Meta.Country, v.Meta.TSP)
+		forward(w, r)
+		return
+	}
+	bestKey, rule := v.MatchedKey, *v.Rule
+
+	log.Printf("[RULE MATCH] key=%s IP=%s ASN=%q Country=%q TSP=%q Drop%%=%g Mode=%q Enabled=%v Hash=%d Combined=%v",
+		bestKey, ip, rule.ASN, rule.Country, rule.TSP, rule.DropRate(), rule.DropMode, rule.Enabled, v.Hash, v.CombinedKeys)
+	setDebug(w, "X-Alak-Rule-Key", bestKey)
+
+	switch v.Reason {
+	case "disabled":
+		passf("[PASS] Rule disabled for ASN=%q Country=%q TSP=%q", rule.ASN, rule.Country, rule.TSP)
+		forward(w, r)
+		return
+	case "off_schedule":
+		passf("[PASS] Rule outside schedule key=%s window=%d-%d tz=%q", bestKey, *rule.StartHour, *rule.EndHour, rule.Timezone)
+		forward(w, r)
+		return
+	case "shadow":
+		if v.Decision == "shadow-drop" {
+			wouldDrops.With(labels).Inc()
+			log.Printf("[DEBUG] [SHADOW] Would drop IP=%s key=%s; allowing request", ip, bestKey)
+			decide(w, "shadow-drop")
+		}
+		forward(w, r)
+		return
+	}
+
+	if v.Decision == "drop" {
+		drops.With(labels).Inc()
+		decide(w, "drop")
+		if rule.TarpitMs > 0 && !tarpit(r, time.Duration(rule.TarpitMs)*time.Millisecond) {
+			debugf("[DEBUG] Client IP=%s left during tarpit key=%s", ip, bestKey)
+			return
+		}
+		if rule.RedirectURL != "" {
+			log.Printf("[DEBUG] Redirecting IP=%s key=%s to %s", ip, bestKey, rule.RedirectURL)
+			http.Redirect(w, r, redirectTarget(rule.RedirectURL, r), http.StatusFound)
+			return
+		}
+		block(w, r)
+		return
+	}
+
+	passf("[PASS] Request allowed for IP %s", ip)
+	forward(w, r)
+}
+
+// What the bogon, geo and rule steps decide for a client IP. proxyHandler
+// acts on it; GET /admin/explain returns it. Field names follow the
+// controller's /evaluate.
+type verdict struct {
+	IP           string      `json:"ip"`
+	Meta         *rules.Meta `json:"meta,omitempty"`
+	KeysChecked  []string    `json:"keys_checked,omitempty"`
+	MatchedKey   string      `json:"matched_key,omitempty"`
+	CombinedKeys []string    `json:"combined_keys,omitempty"`
+	Rule         *rules.Rule `json:"rule,omitempty"` // with the combined drop rate
+	Hash         int         `json:"hash"`
+	HashPerMille int         `json:"hash_per_mille"`
+	Decision     string      `json:"decision"` // pass, drop, shadow-drop
+	// bogon, no_geo_data, no_rule, disabled, off_schedule, shadow, or the
+	// drop_mode (sticky, random) that picked the outcome
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// A failed geo or Redis read; reason is the alak_failclosed_total label.
+type lookupError struct {
+	reason, msg string
+}
+
+func (e *lookupError) Error() string { return e.msg }
+
+// Runs the bogon check, geo lookup and rule resolution for ip, with
+// uaClass ("" unless UA_RULES) as the rule lookup's UA dimension. On a
+// *lookupError the verdict holds whatever was learned before it (Meta
+// after a Redis failure). Random-mode rules roll the dice here, once.
+// Rule reads give up when ctx (the client's request) is done.
+func classify(ctx context.Context, ip, uaClass string) (verdict, error) {
+	v := verdict{IP: ip, Hash: rules.HashIP(ip), HashPerMille: rules.HashIPPerMille(ip), Decision: "pass"}
+
+	// Private/loopback/bogon sources (health checks, a misconfigured edge)
+	// never have geo data; skip the lookup that would only 404.
+	if ipInNets(ip, cfg.BogonNets) {
+		v.Reason = "bogon"
+		return v, nil
+	}
+
+	// --- Geo lookup (fail-open) ---
+	lookupURL := fmt.Sprintf("%s?ip=%s", cfg.GeoURL, ip)
+	resp, err := http.Get(lookupURL)
+	if err != nil {
+		return v, &lookupError{"geo", fmt.Sprintf("GeoIP lookup error for IP %s: %v", ip, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		v.Reason = "no_geo_data"
+		return v, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return v, &lookupError{"geo", fmt.Sprintf("GeoIP lookup failed for IP %s: status %d", ip, resp.StatusCode)}
+	}
+
+	var meta rules.Meta
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return v, &lookupError{"geo", fmt.Sprintf("Failed to decode GeoIP response for IP %s: %v", ip, err)}
+	}
+	meta = rules.CleanMeta(meta)
+	meta.UAClass = uaClass
+	v.Meta = &meta
+	v.KeysChecked = rules.LookupKeys(meta)
+
+	match, err := rules.Resolve(v.KeysChecked, time.Now(), cfg.ScheduleTZ, func(key string) (string, bool, error) {
+		return getRule(ctx, key)
+	})
+	if errors.Is(err, rules.ErrCorruptRule) {
+		return v, &lookupError{"redis", fmt.Sprintf("Failed to unmarshal rule: %v", err)}
+	} else if err != nil {
+		return v, &lookupError{"redis", fmt.Sprintf("Redis get error: %v", err)}
+	}
+	if match == nil {
+		v.Reason = "no_rule"
+		return v, nil
+	}
+	rule := match.Rule
+	rule.DropPercent, rule.DropPerMille = match.DropPercent, match.DropPerMille
+	v.MatchedKey, v.CombinedKeys, v.Rule = match.Key, match.Combined, &rule
+
+	switch {
+	case !rule.Enabled:
+		v.Reason = "disabled"
+	case !rule.ActiveAt(time.Now(), cfg.ScheduleTZ):
+		v.Reason = "off_schedule"
+	case rule.Shadow:
+		v.Reason = "shadow"
+		if rule.ShouldDrop(ip) {
+			v.Decision = "shadow-drop"
+		}
+	default:
+		v.Reason = "sticky"
+		if rule.DropMode == "random" {
+			v.Reason = "random"
+		}
+		if rule.ShouldDrop(ip) {
+			v.Decision = "drop"
+		}
+	}
+	return v, nil
+}
+
+const edgeHeader = "X-Alak-Edge"
+
+// RFC 1918, CGNAT, loopback, link-local, "this network", and the IPv6
+// loopback, ULA and link-local ranges
+const defaultBogonCIDRs = "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,0.0.0.0/8,::1/128,fc00::/7,fe80::/10"
+
+// Labels for requests/drops/wouldDrops under METRICS_CARDINALITY. The label
+// names never change, so dashboards keep working; dropped dimensions are "".
+func metricLabels(meta rules.Meta) prometheus.Labels {
+	switch cfg.MetricsCardinality {
+	case "country":
+		return prometheus.Labels{"asn": "", "country": meta.Country, "tsp": ""}
+	case "asn":
+		asn := meta.ASN
+		metricASNsMu.Lock()
+		metricASNCounts[asn]++
+		if !metricASNs[asn] {
+			// Free places (at start, or after demotions) go to whoever comes;
+			// reselectMetricASNs settles who deserves them
+			if len(metricASNs) < cfg.MetricsTopASNs {
+				metricASNs[asn] = true
+			} else {
+				asn = "other"
+			}
+		}
+		metricASNsMu.Unlock()
+		return prometheus.Labels{"asn": asn, "country": meta.Country, "tsp": ""}
+	}
+	return prometheus.Labels{"asn": meta.ASN, "country": meta.Country, "tsp": meta.TSP}
+}
+
+// How often METRICS_CARDINALITY=asn re-picks its labeled ASNs
+const metricASNsInterval = time.Minute
+
+func reselectMetricASNsEvery(every time.Duration) {
+	for range time.Tick(every) {
+		reselectMetricASNs()
+	}
+}
+
+// Gives the METRICS_TOP_ASNS labels to the ASNs with the most requests,
+// counted with a half-life of one interval so yesterday's leaders fade
+// out. Demoted ASNs lose their series (they count as "other" from now
+// on), which keeps the series count bounded by METRICS_TOP_ASNS.
+func reselectMetricASNs() {
+	metricASNsMu.Lock()
+	asns := make([]string, 0, len(metricASNCounts))
+	for asn := range metricASNCounts {
+		asns = append(asns, asn)
+	}
+	slices.SortFunc(asns, func(a, b string) int {
+		if c := cmp.Compare(metricASNCounts[b], metricASNCounts[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	top := map[string]bool{}
+	for _, asn := range asns[:min(len(asns), cfg.MetricsTopASNs)] {
+		top[asn] = true
+	}
+	var demoted []string
+	for asn := range metricASNs {
+		if !top[asn] {
+			demoted = append(demoted, asn)
+		}
+	}
+	metricASNs = top
+	for asn, n := range metricASNCounts {
+		if n /= 2; n < 1 {
+			delete(metricASNCounts, asn)
+		} else {
+			metricASNCounts[asn] = n
+		}
+	}
+	metricASNsMu.Unlock()
+
+	for _, asn := range demoted {
+		for _, vec := range []*prometheus.CounterVec{requests, drops, wouldDrops} {
+			vec.DeletePartialMatch(prometheus.Labels{"asn": asn})
+		}
+	}
+}
+
+// Proxies r upstream with SNI from its Host. XFF_MODE applies once the
+// client IP is known: replace sends that IP as the whole X-Forwarded-For
+// (ReverseProxy appends RemoteAddr, so the copy's RemoteAddr becomes the
+// client), real-ip keeps the appended chain and sets X-Real-IP.
+//
+// Requests beyond MAX_CONCURRENT, SSE included, get 503 rather than
+// another upstream connection; WebSocket upgrades are only counted.
+func forward(w http.ResponseWriter, r *http.Request) {
+	// Only real upgrades skip the slot: they stay open by design and are
+	// tracked on their own. Accept: text/event-stream is the client's to
+	// set, so SSE requests take a slot like any other.
+	kind := "request"
+	if isUpgrade(r) {
+		kind = "long_lived"
+	} else if concurrencySlots != nil {
+		select {
+		case concurrencySlots <- struct{}{}:
+			defer func() { <-concurrencySlots }()
+		default:
+			concurrencyRejections.Inc()
+			decide(w, "overload")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	inflight.WithLabelValues(kind).Inc()
+	defer inflight.WithLabelValues(kind).Dec()
+
+	out := r.WithContext(withSNI(r.Context(), desiredSNI(r)))
+	if ip, _ := r.Context().Value(clientIPCtxKey{}).(string); ip != "" {
+		switch cfg.XFFMode {
+		case "replace":
+			out.Header.Del("X-Forwarded-For")
+			out.RemoteAddr = net.JoinHostPort(ip, "0")
+		case "real-ip":
+			out.Header.Set("X-Real-Ip", ip)
+		}
+	}
+	reverseProxy.ServeHTTP(w, out)
+}
+
+// Redis getter for rules.Resolve. A missing key is not an error; a
+// transient failure is retried up to REDIS_LOOKUP_RETRIES times so one
+// blip doesn't admit traffic via fail-open. A client that has gone away
+// (ctx done) stops the retries.
+func getRule(ctx context.Context, key string) (string, bool, error) {
+	val, err := redisClient.Get(ctx, key).Result()
+	backoff := cfg.RedisRetryBackoff
+	for i := 0; i < cfg.RedisLookupRetries && err != nil && err != redis.Nil && transientRedisErr(err); i++ {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		}
+		backoff *= 2
+		val, err = redisClient.Get(ctx, key).Result()
+		if err == nil || err == redis.Nil {
+			redisRetries.WithLabelValues("ok").Inc()
+		} else {
+			redisRetries.WithLabelValues("error").Inc()
+		}
+	}
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	return val, err == nil, err
+}
+
+// Network errors, timeouts and pool exhaustion are worth another try;
+// Redis error replies are not, except the ones a failover produces.
+func transientRedisErr(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var reply redis.Error
+	if !errors.As(err, &reply) {
+		return true
+	}
+	for _, p := range []string{"LOADING ", "READONLY ", "CLUSTERDOWN ", "TRYAGAIN ", "MASTERDOWN "} {
+		if strings.HasPrefix(err.Error(), p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Geo/Redis error path. FAIL_MODE=open (default) proxies the request as if
+// no rule matched; closed blocks it, trading availability for never
+// admitting traffic we couldn't classify.
+func onLookupError(w http.ResponseWriter, r *http.Request, reason, format string, args ...any) {
+	if cfg.FailClosed {
+		failClosedTotal.WithLabelValues(reason).Inc()
+		log.Printf("[FAIL-CLOSED] "+format+"; blocking request", args...)
+		decide(w, "fail-closed")
+		block(w, r)
+		return
+	}
+	log.Printf("[FAIL-OPEN] "+format+"; allowing request", args...)
+	forward(w, r)
+}
+
+// Holds a dropped request for d before its answer is written. Reports
+// false when the client went away first, so there's no one to answer.
+// With every slot taken the request isn't held at all.
+func tarpit(r *http.Request, d time.Duration) bool {
+	select {
+	case tarpitSlots <- struct{}{}:
+	default:
+		tarpitOverflow.Inc()
+		return true
+	}
+	tarpitActive.Inc()
+	defer func() {
+		tarpitActive.Dec()
+		<-tarpitSlots
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// Works out the block body's Content-Type, and its gzip form when that is
+// actually smaller, once rather than per blocked request.
+func setBlockBody(body []byte) {
+	blockContentType = http.DetectContentType(body)
+	blockBodyGzip = nil
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(body)
+	_ = zw.Close()
+	if gz.Len() < len(body) {
+		blockBodyGzip = gz.Bytes()
+	}
+}
+
+func block(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", blockContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+	body := cfg.BlockBody
+	if blockBodyGzip != nil {
+		h.Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.Set("Content-Encoding", "gzip")
+			body = blockBodyGzip
+		}
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusForbidden)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+// Whether an Accept-Encoding value allows gzip: listed (or "*") with a
+// non-zero q; an explicit gzip entry overrides "*".
+func acceptsGzip(ae string) bool {
+	star := false
+	for _, part := range strings.Split(ae, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		ok := true
+		if q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); found {
+			v, err := strconv.ParseFloat(q, 64)
+			ok = err == nil && v > 0
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip":
+			return ok
+		case "*":
+			star = ok
+		}
+	}
+	return star
+}
+
+// Per-request chatter (keys checked, why a request passed). Rule matches,
+// drops and fail-open/closed events always go through log.Printf.
+func debugf(format string, args ...any) {
+	if cfg.VerboseLog {
+		log.Printf(format, args...)
+	}
+}
+
+// Samples a lookup for comparison against GEO_URL_SECONDARY in the
+// background. Never blocks: when GEO_SECONDARY_MAX_INFLIGHT checks are
+// already running the sample is skipped. The primary answer always decides.
+func crossCheckGeo(ip string, primary rules.Meta) {
+	if cfg.GeoSecondaryURL == "" || (geoSecondarySeq.Add(1)-1)%cfg.GeoSecondaryRate != 0 {
+		return
+	}
+	select {
+	case geoSecondarySlots <- struct{}{}:
+	default:
+		geoCrossChecks.WithLabelValues("skipped").Inc()
+		return
+	}
+	go func() {
+		defer func() { <-geoSecondarySlots }()
+		resp, err := geoSecondaryClient.Get(fmt.Sprintf("%s?ip=%s", cfg.GeoSecondaryURL, ip))
+		if err != nil {
+			geoCrossChecks.WithLabelValues("error").Inc()
+			debugf("[GEO-CHECK] Secondary lookup for IP %s failed: %v", ip, err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			geoCrossChecks.WithLabelValues("not_found").Inc()
+			log.Printf("[GEO-CHECK] IP %s: secondary has no data; primary ASN=%q Country=%q", ip, primary.ASN, primary.Country)
+			return
+		}
+		var other rules.Meta
+		if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&other) != nil {
+			geoCrossChecks.WithLabelValues("error").Inc()
+			debugf("[GEO-CHECK] Secondary lookup for IP %s: status %d or undecodable body", ip, resp.StatusCode)
+			return
+		}
+		other = rules.CleanMeta(other)
+		asnDiff, countryDiff := other.ASN != primary.ASN, other.Country != primary.Country
+		if asnDiff {
+			geoDisagreements.WithLabelValues("asn").Inc()
+		}
+		if countryDiff {
+			geoDisagreements.WithLabelValues("country").Inc()
+		}
+		if !asnDiff && !countryDiff {
+			geoCrossChecks.WithLabelValues("agree").Inc()
+			return
+		}
+		geoCrossChecks.WithLabelValues("disagree").Inc()
+		log.Printf("[GEO-CHECK] IP %s: primary ASN=%q Country=%q, secondary ASN=%q Country=%q",
+			ip, primary.ASN, primary.Country, other.ASN, other.Country)
+	}()
+}
+
+// debugf for [PASS] lines, additionally thinned to 1 in LOG_SAMPLE_RATE.
+func passf(format string, args ...any) {
+	if cfg.VerboseLog && (passSeq.Add(1)-1)%cfg.LogSampleRate == 0 {
+		log.Printf(format, args...)
+	}
+}
+
+// No-op unless DEBUG_HEADERS: these reveal the client's geo data and our
+// rules, so production responses must never carry them.
+func setDebug(w http.ResponseWriter, k, v string) {
+	if cfg.DebugHeaders {
+		w.Header().Set(k, v)
+	}
+}
+
+// Records the request's outcome for X-Alak-Decision and the access log.
+func decide(w http.ResponseWriter, decision string) {
+	setDebug(w, "X-Alak-Decision", decision)
+	if rec, ok := w.(*accessRecorder); ok {
+		rec.decision = decision
+	}
+}
+
+// ---- Access log ----
+
+// Captures what the access log needs. Flush and Hijack reach the real
+// writer through Unwrap (http.ResponseController), so SSE and WebSocket
+// upgrades work unchanged; Hijack is wrapped only to log the 101.
+type accessRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	client   string
+	decision string
 }
 
-type Meta struct {
-	ASN     string `json:"asn"`
-	Country string `json:"country"`
-	TSP     string `json:"tsp"`
-	City    string `json:"city"`
+func (a *accessRecorder) WriteHeader(code int) {
+	// Informational headers (103 Early Hints) precede the real status;
+	// 101 is the final one for an upgrade
+	if a.status == 0 && (code >= http.StatusOK || code == http.StatusSwitchingProtocols) {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
 }
 
-func cleanField(s string, isCountry bool) string {
-	s = strings.TrimSpace(s)
-	if s == "-" {
-		s = ""
+func (a *accessRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
 	}
-	if isCountry {
-		s = strings.ToUpper(s)
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += int64(n)
+	return n, err
+}
+
+func (a *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, rw, err := http.NewResponseController(a.ResponseWriter).Hijack()
+	if err == nil {
+		a.status = http.StatusSwitchingProtocols
 	}
-	return s
+	return c, rw, err
 }
 
-var (
-	ctx         = context.Background()
-	redisClient *redis.Client
+func (a *accessRecorder) Unwrap() http.ResponseWriter { return a.ResponseWriter }
 
-	geoURL     string
-	haProxyURL string
+// NCSA Common/Combined line, plus the duration in seconds and the decision:
+// 1.2.3.4 - - [02/Jan/2006:15:04:05 -0700] "GET /x HTTP/1.1" 200 512 "ref" "ua" 0.012 pass
+func withAccessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		next(rec, r)
 
-	// parsed upstream and global TLS flags for transport
-	hapURL           *url.URL
-	skipVerifyGlobal bool
-	reverseProxy     *httputil.ReverseProxy
-	sniOverride      = getenv("ALAK_SNI_OVERRIDE", "")
+		client := rec.client
+		if client == "" {
+			client = hostNoPort(r.RemoteAddr)
+		}
+		bytes := "-"
+		if rec.bytes > 0 {
+			bytes = strconv.FormatInt(rec.bytes, 10)
+		}
+		decision := rec.decision
+		if decision == "" {
+			decision = "-"
+		}
+		status := rec.status
+		if status == 0 { // handler wrote nothing: net/http sends 200
+			status = http.StatusOK
+		}
+		line := fmt.Sprintf("%s - - [%s] %q %d %s",
+			strings.ReplaceAll(client, " ", ""), start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto, status, bytes)
+		if cfg.AccessLogFormat == "combined" {
+			line += fmt.Sprintf(" %q %q", orDash(r.Referer()), orDash(r.UserAgent()))
+		}
+		accessLog.Printf("%s %.3f %s", line, time.Since(start).Seconds(), decision)
+	}
+}
 
-	requests = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "alak_requests_total",
-			Help: "Total incoming requests by ASN, country, and TSP",
-		},
-		[]string{"asn", "country", "tsp"},
-	)
-	drops = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "alak_drops_total",
-			Help: "Total dropped requests by ASN, country, and TSP",
-		},
-		[]string{"asn", "country", "tsp"},
-	)
-)
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
 
-// ctx key to pass SNI (servername) into DialTLSContext
-type sniCtxKey struct{}
+// Client-sent headers matching STRIP_HEADERS never reach clientIP or the
+// upstream; the proxy's own X-Forwarded-* are set later, in the Director.
+// The edge secret is exempt: clientIP needs it, the Director drops it.
+func stripHeaders(h http.Header) {
+	for k := range h {
+		lk := strings.ToLower(k)
+		if lk == strings.ToLower(edgeHeader) {
+			continue
+		}
+		if cfg.StripExact[lk] || slices.ContainsFunc(cfg.StripPrefixes, func(p string) bool { return strings.HasPrefix(lk, p) }) {
+			h.Del(k)
+		}
+	}
+}
 
-func init() {
-	prometheus.MustRegister(requests)
-	prometheus.MustRegister(drops)
+// Open proxies and spoofers tend to send long XFF chains, or an X-Real-IP
+// that appears nowhere in the chain. Both checks are off by default; an
+// untrusted XFF was already removed by clientIP and never counts.
+func headerAnomaly(r *http.Request) string {
+	xff := r.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		return ""
+	}
+	var hops []string
+	for _, v := range xff {
+		for _, h := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(h))
+		}
+	}
+	if cfg.XFFMaxDepth > 0 && len(hops) > cfg.XFFMaxDepth {
+		return "xff_depth"
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-Ip")); cfg.XFFRealIPCheck && realIP != "" && !slices.Contains(hops, realIP) {
+		return "real_ip_mismatch"
+	}
+	return ""
 }
 
-func main() {
-	geoURL = getenv("ALAK_GEO_URL", "http://alak-geo:8081/lookup")
-	haProxyURL = getenv("HA_PROXY_URL", "http://haproxy:80")
+// Forwarding metadata a client can forge; dropped from any request that
+// doesn't carry the edge secret
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded"}
 
-	var err error
-	hapURL, err = url.Parse(haProxyURL)
-	if err != nil {
-		log.Fatalf("invalid HA_PROXY_URL %q: %v", haProxyURL, err)
+// The client hop of XFF when it comes from the trusted edge (EDGE_SECRET
+// matches X-Alak-Edge, or no secret configured), else the socket peer. A
+// client hitting us directly can't pick its own ASN by forging XFF, nor
+// (since the forged headers are removed) hand the upstream a chain
+// ReverseProxy would extend. An XFF whose client hop isn't an IP gives "",
+// left to MISSING_IP_POLICY.
+func clientIP(r *http.Request) string {
+	xff := r.Header.Get("X-Forwarded-For")
+	if cfg.EdgeSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(edgeHeader)), []byte(cfg.EdgeSecret)) != 1 {
+		if xff != "" {
+			untrustedXFF.Inc()
+			log.Printf("[WARN] Ignoring X-Forwarded-For=%q from %s: missing or invalid %s", xff, r.RemoteAddr, edgeHeader)
+			xff = ""
+		}
+		// X-Real-IP or Forwarded sent alone is just as forged
+		for _, h := range forwardedHeaders {
+			r.Header.Del(h)
+		}
 	}
+	if xff != "" {
+		return xffClient(xff)
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
 
-	redisHost := getenv("REDIS_HOST", "localhost:6379")
-	redisClient = redis.NewClient(&redis.Options{Addr: redisHost})
-
-	skipTLSVerify := strings.EqualFold(getenv("SKIP_TLS_VERIFY", "true"), "true")
-	skipVerifyGlobal = skipTLSVerify
-	if skipTLSVerify {
-		log.Printf("⚠️  SKIP_TLS_VERIFY=true — backend TLS certificate verification is disabled.")
+// First hop of an X-Forwarded-For value, "client, proxy1, proxy2": the
+// address the edge saw the request come from. A port some proxies add
+// ("1.2.3.4:5678", "[2001:db8::1]:443") is dropped.
+func xffClient(xff string) string {
+	hop, _, _ := strings.Cut(xff, ",")
+	hop = hostNoPort(strings.TrimSpace(hop))
+	if ip := net.ParseIP(strings.Trim(hop, "[]")); ip != nil {
+		return ip.String()
 	}
+	return ""
+}
 
-	transport := newUpstreamTransport(skipTLSVerify)
-	reverseProxy = newReverseProxy(transport)
+// ---- PROXY protocol (L4 edges) ----
 
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok\n"))
-	})
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", proxyHandler)
+const proxyProtoHeaderTimeout = 5 * time.Second
 
-	port := getenv("PORT", "8090")
-	log.Printf("Alak Gatekeeper listening on :%s (upstream=%s, geo=%s, skip_verify=%v, sni_override=%q)",
-		port, haProxyURL, geoURL, skipTLSVerify, sniOverride)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Wraps the main listener so connections from trusted peers have their
+// RemoteAddr replaced by the client address in a PROXY v1/v2 header.
+// Untrusted peers are served as-is: a header they send is just a bad request.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
 }
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	// --- Client IP extraction (prefer XFF set by edge HAProxy) ---
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
 	}
-	if ip == "" {
-		log.Printf("[ERROR] No client IP found in request")
-		http.Error(w, "Missing X-Forwarded-For header", http.StatusBadRequest)
-		return
+	if !ipInNets(hostNoPort(c.RemoteAddr().String()), l.trusted) {
+		return c, nil
 	}
+	return &proxyProtoConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
 
-	// --- Geo lookup (fail-open) ---
-	lookupURL := fmt.Sprintf("%s?ip=%s", geoURL, ip)
-	resp, err := http.Get(lookupURL)
-	if err != nil {
-		log.Printf("[FAIL-OPEN] GeoIP lookup error for IP %s: %v; allowing request", ip, err)
-		reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
-		return
-	}
-	defer resp.Body.Close()
+// The header is parsed lazily on first Read/RemoteAddr, which net/http does
+// from the connection's own goroutine, so a slow peer never stalls Accept.
+type proxyProtoConn struct {
+	net.Conn
+	br     *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
 
-	if resp.StatusCode == http.StatusNotFound {
-		log.Printf("[PASS] No GeoIP data for IP %s", ip)
-		reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[FAIL-OPEN] GeoIP lookup failed for IP %s: status %d; allowing request", ip, resp.StatusCode)
-		reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
-		return
-	}
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.br)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			proxyProtoErrors.Inc()
+			log.Printf("[WARN] PROXY protocol from %s: %v; closing connection", c.Conn.RemoteAddr(), c.err)
+			_ = c.Conn.Close()
+		}
+	})
+}
 
-	var meta Meta
-	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
-		log.Printf("[FAIL-OPEN] Failed to decode GeoIP response for IP %s: %v; allowing request", ip, err)
-		reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
-		return
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
 	}
+	return c.br.Read(p)
+}
 
-	meta.ASN = cleanField(meta.ASN, false)
-	meta.Country = cleanField(meta.Country, true)
-	meta.TSP = cleanField(meta.TSP, false)
-
-	labels := prometheus.Labels{
-		"asn":     meta.ASN,
-		"country": meta.Country,
-		"tsp":     meta.TSP,
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
 	}
-	requests.With(labels).Inc()
+	return c.Conn.RemoteAddr()
+}
 
-	ruleKeys := buildRuleKeys(meta)
-	log.Printf("[DEBUG] IP=%s ASN=%q Country=%q TSP=%q; Keys checked: %v", ip, meta.ASN, meta.Country, meta.TSP, ruleKeys)
+// Consumes a v1 or v2 header and returns the source address it carries.
+// No header (e.g. LB health checks), LOCAL and UNKNOWN yield nil, meaning
+// keep the socket peer.
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	if sig, err := br.Peek(len(proxyProtoV2Sig)); err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+		return readProxyHeaderV2(br)
+	}
+	if pre, err := br.Peek(6); err == nil && string(pre) == "PROXY " {
+		return readProxyHeaderV1(br)
+	}
+	return nil, nil
+}
 
-	var (
-		found   bool
-		rule    Rule
-		bestKey string
-	)
-	for _, key := range ruleKeys {
-		val, err := redisClient.Get(ctx, key).Result()
-		if err == redis.Nil {
-			continue
-		} else if err != nil {
-			log.Printf("[FAIL-OPEN] Redis get error: %v; allowing request", err)
-			reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
-			return
+// PROXY TCP4|TCP6|UNKNOWN <src> <dst> <sport> <dport>\r\n, at most 107 bytes.
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("v1 header: %w", err)
 		}
-		if err := json.Unmarshal([]byte(val), &rule); err != nil {
-			log.Printf("[FAIL-OPEN] Failed to unmarshal rule at %s: %v; allowing request", key, err)
-			reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
-			return
+		line = append(line, b)
+		if b == '\n' {
+			break
 		}
-		found = true
-		bestKey = key
-		break
 	}
-
-	if !found {
-		log.Printf("[PASS] No matching rule for IP=%s ASN=%q Country=%q TSP=%q", ip, meta.ASN, meta.Country, meta.TSP)
-		reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
-		return
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header: missing CRLF")
 	}
-
-	log.Printf("[RULE MATCH] key=%s IP=%s ASN=%q Country=%q TSP=%q Drop%%=%d Enabled=%v Hash=%d",
-		bestKey, ip, rule.ASN, rule.Country, rule.TSP, rule.DropPercent, rule.Enabled, hashIP(ip))
-
-	if !rule.Enabled {
-		log.Printf("[PASS] Rule disabled for ASN=%q Country=%q TSP=%q", rule.ASN, rule.Country, rule.TSP)
-		reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
-		return
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
 	}
-
-	hash := hashIP(ip)
-	if hash < rule.DropPercent {
-		drops.With(labels).Inc()
-		w.WriteHeader(http.StatusForbidden)
-		_, _ = w.Write([]byte("Request blocked by Alak Gatekeeper\n"))
-		return
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("v1 header: malformed %q", line)
 	}
-
-	log.Printf("[PASS] Request allowed for IP %s", ip)
-	reverseProxy.ServeHTTP(w, r.WithContext(withSNI(r.Context(), desiredSNI(r))))
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("v1 header: bad source %s:%s", f[2], f[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
 }
 
-func buildRuleKeys(meta Meta) []string {
-	var keys []string
-	asnSet := meta.ASN != "" && meta.TSP != ""
-	countrySet := meta.Country != ""
-
-	if asnSet {
-		if countrySet {
-			keys = append(keys, fmt.Sprintf("rule:%s:%s:%s", meta.ASN, meta.Country, meta.TSP))
-			keys = append(keys, fmt.Sprintf("rule:%s:%s:*", meta.ASN, meta.Country))
-			keys = append(keys, fmt.Sprintf("rule:%s:*:%s", meta.ASN, meta.TSP))
-			keys = append(keys, fmt.Sprintf("rule:%s:*:*", meta.ASN))
-		} else {
-			keys = append(keys, fmt.Sprintf("rule:%s:*:%s", meta.ASN, meta.TSP))
-			keys = append(keys, fmt.Sprintf("rule:%s:*:*", meta.ASN))
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("v2 header: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("v2 header: version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, fmt.Errorf("v2 header: %w", err)
+	}
+	if hdr[12]&0x0f == 0 { // LOCAL: the proxy's own connection (health checks)
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET: src(4) dst(4) sport dport
+		if len(body) < 12 {
+			return nil, errors.New("v2 header: short IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6: src(16) dst(16) sport dport
+		if len(body) < 36 {
+			return nil, errors.New("v2 header: short IPv6 address block")
 		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default: // AF_UNSPEC / AF_UNIX: nothing usable
+		return nil, nil
 	}
-	if !asnSet && countrySet {
-		keys = append(keys, fmt.Sprintf("rule:*:%s:*", meta.Country))
+}
+
+// Appends the original request URI as ?return=... so a challenge page can
+// bounce the client back once it passes.
+func redirectTarget(target string, r *http.Request) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
 	}
-	keys = append(keys, "rule:*:*:*")
-	return keys
+	q := u.Query()
+	q.Set("return", r.URL.RequestURI())
+	u.RawQuery = q.Encode()
+	return u.String()
 }
 
 // ---- Reverse proxy (long-term solution) ----
 
-func newReverseProxy(tr *http.Transport) *httputil.ReverseProxy {
+func newReverseProxy(c *Config, tr *http.Transport) *httputil.ReverseProxy {
 	rp := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			// Upstream target: edge HAProxy (scheme+host from HA_PROXY_URL)
-			req.URL.Scheme = hapURL.Scheme
-			req.URL.Host = hapURL.Host
-			// Keep origin-form path/query as sent by the client
-			// (ReverseProxy will clear RequestURI for us)
+			// Upstream target: next healthy entry of HA_PROXY_URLS. TLS dials
+			// go to this host; SNI stays the client's Host and only falls
+			// back to it when Host is empty.
+			up := pickUpstream()
+			req.URL.Scheme = up.url.Scheme
+			req.URL.Host = up.url.Host
+			// Keep origin-form path/query as sent by the client, apart from
+			// UPSTREAM_*_PREFIX (ReverseProxy will clear RequestURI for us)
+			rewritePath(req.URL, c.UpstreamStripPrefix, c.UpstreamAddPrefix)
+
+			// The edge secret is for us only; never leak it upstream
+			req.Header.Del(edgeHeader)
 
 			// Preserve Host for Ingress host-based routing (and for SNI via context)
 			cleanHost := desiredSNI(req)
@@ -272,55 +2008,430 @@ func newReverseProxy(tr *http.Transport) *httputil.ReverseProxy {
 			}
 			req.Header.Set("X-Forwarded-Host", cleanHost)
 
+			// Without a client Accept-Encoding the transport would ask for
+			// gzip and inflate it itself, and the inflater holds events back
+			// until a compressed block fills. Ask streams for identity; a
+			// client that negotiated its own encoding gets it passed through.
+			if isLongLived(req) && req.Header.Get("Accept-Encoding") == "" {
+				req.Header.Set("Accept-Encoding", "identity")
+			}
+
 			// Let ReverseProxy append X-Forwarded-For; ensure existing chain remains
 			// (no change needed; it preserves existing header and appends RemoteAddr)
 
-			// Inject per-request SNI for upstream TLS handshakes
+			// Inject per-request SNI for upstream TLS handshakes, and the
+			// chosen upstream so ErrorHandler can mark it down
 			ctx := withSNI(req.Context(), cleanHost)
+			ctx = context.WithValue(ctx, upstreamCtxKey{}, up)
+
+			// Bound plain requests; WebSocket upgrades and SSE stay open-ended.
+			// timedTransport releases the timer when the round trip fails or
+			// the response body is closed.
+			if c.UpstreamTimeout > 0 && !isLongLived(req) {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, c.UpstreamTimeout)
+				ctx = context.WithValue(ctx, deadlineCancelCtxKey{}, cancel)
+			}
+			ctx = context.WithValue(ctx, requestCtxKey{}, ctx)
+
+			// Only allowlisted hosts are dialed or named in SNI, whatever
+			// picked them. The Director can't answer, so a refused request
+			// gets a context cancelled with errUpstreamNotAllowed: the
+			// transport returns at once and ErrorHandler sends the 502.
+			for _, h := range []string{req.URL.Hostname(), c.SNIOverride} {
+				if h != "" && !c.UpstreamHostAllow[strings.ToLower(h)] {
+					log.Printf("[UPSTREAM] Refusing %s %s: host %q is not in UPSTREAM_HOST_ALLOWLIST", req.Method, req.URL.Path, h)
+					var refuse context.CancelCauseFunc
+					ctx, refuse = context.WithCancelCause(ctx)
+					refuse(fmt.Errorf("%w: %q", errUpstreamNotAllowed, h))
+					break
+				}
+			}
 			*req = *req.WithContext(ctx)
 		},
-		Transport: tr,
-		ErrorLog:  log.New(os.Stdout, "[reverse-proxy] ", log.LstdFlags),
+		Transport: timedTransport{tr},
+		// text/event-stream and unknown-length (chunked) responses are
+		// flushed after every write regardless; this bounds buffering for
+		// everything else that trickles.
+		FlushInterval: 100 * time.Millisecond,
+		ErrorLog:      log.New(os.Stdout, "[reverse-proxy] ", log.LstdFlags),
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(context.Cause(r.Context()), errUpstreamNotAllowed) {
+				// Refused by the Director (and logged there); our
+				// misconfiguration, not the upstream's failure, so its
+				// health is left alone
+				http.Error(w, "Upstream error", http.StatusBadGateway)
+				return
+			}
 			log.Printf("[PROXY ERROR] %s %s: %v", r.Method, r.URL.String(), err)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				http.Error(w, "Upstream timeout", http.StatusGatewayTimeout)
+				return
+			}
+			// Passive health: a failed round trip takes the upstream out of
+			// rotation until the next successful probe. Client aborts don't.
+			if up, ok := r.Context().Value(upstreamCtxKey{}).(*upstream); ok && !errors.Is(err, context.Canceled) {
+				if up.setHealthy(false) {
+					log.Printf("[UPSTREAM] %s marked down: %v", up.url.Host, err)
+				}
+			}
 			http.Error(w, "Upstream error", http.StatusBadGateway)
 		},
 	}
 	return rp
 }
 
+// A path prefix env: "/" or unset is none, the trailing "/" is dropped so
+// "/api/" and "/api" behave the same.
+func pathPrefixEnv(k string) (string, error) {
+	v := strings.TrimSpace(getenv(k, ""))
+	if v == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(v, "/") || strings.ContainsAny(v, "?#") {
+		return "", fmt.Errorf("invalid %s %q (want a path starting with /)", k, v)
+	}
+	return strings.TrimRight(v, "/"), nil
+}
+
+// Removes strip from the start of u's path when it matches whole segments
+// ("/api" strips "/api" and "/api/x", not "/apix"), then prepends add.
+// Works on the escaped path, so RawPath and encoded slashes survive; the
+// query is untouched. A path stripped to nothing becomes "/".
+func rewritePath(u *url.URL, strip, add string) {
+	ep := u.EscapedPath()
+	if (strip == "" && add == "") || !strings.HasPrefix(ep, "/") {
+		return // nothing to do, or not origin-form ("*" for OPTIONS)
+	}
+	if strip != "" {
+		strip = (&url.URL{Path: strip}).EscapedPath()
+		if rest, ok := strings.CutPrefix(ep, strip); ok && (rest == "" || rest[0] == '/') {
+			ep = rest
+			if ep == "" {
+				ep = "/"
+			}
+		}
+	}
+	if add != "" {
+		ep = (&url.URL{Path: add}).EscapedPath() + ep
+	}
+	p, err := url.PathUnescape(ep)
+	if err != nil {
+		return // EscapedPath output always unescapes
+	}
+	u.Path, u.RawPath = p, ""
+	if (&url.URL{Path: p}).EscapedPath() != ep {
+		u.RawPath = ep
+	}
+}
+
+// ---- Upstream pool ----
+
+type upstream struct {
+	url     *url.URL
+	healthy atomic.Bool
+}
+
+// Reports whether the state changed, keeping the gauge in step
+func (u *upstream) setHealthy(ok bool) bool {
+	v := 0.0
+	if ok {
+		v = 1
+	}
+	upstreamHealthy.WithLabelValues(u.url.Host).Set(v)
+	return u.healthy.Swap(ok) != ok
+}
+
+// Round-robin over healthy upstreams. With all of them down it keeps
+// rotating through the full list rather than refusing every request.
+func pickUpstream() *upstream {
+	n := uint64(len(upstreams))
+	start := upstreamNext.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if up := upstreams[(start+i)%n]; up.healthy.Load() {
+			return up
+		}
+	}
+	return upstreams[start%n]
+}
+
+// Refreshes bypassActive from Redis every interval. A failed read keeps
+// the last known state rather than flapping filtering on a Redis blip.
+func pollBypass(interval time.Duration) {
+	last := time.Now()
+	for {
+		on := bypassActive.Load()
+		val, err := redisClient.Get(ctx, cfg.BypassKey).Result()
+		switch {
+		case err == nil || err == redis.Nil:
+			on = val == "1" || strings.EqualFold(val, "true")
+		default:
+			log.Printf("[WARN] Reading %s: %v; keeping bypass=%v", cfg.BypassKey, err, on)
+		}
+		now := time.Now()
+		if bypassActive.Load() {
+			bypassSeconds.Add(now.Sub(last).Seconds())
+		}
+		last = now
+		if bypassActive.Swap(on) != on {
+			if on {
+				log.Printf("⚠️  [BYPASS] %s is set — all filtering is OFF, every request is proxied", cfg.BypassKey)
+			} else {
+				log.Printf("[BYPASS] %s cleared — filtering resumed", cfg.BypassKey)
+			}
+		}
+		if on {
+			bypassGauge.Set(1)
+		} else {
+			bypassGauge.Set(0)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// ---- Deny list ----
+
+// Exact IPs in a map, prefixes in a binary trie over the 16-byte form
+// (IPv4 as ::ffff:a.b.c.d), so a lookup costs at most 128 steps however
+// many CIDRs are listed. Rebuilt whole on refresh, never mutated.
+type denyList struct {
+	ips  map[string]bool
+	cidr *trieNode
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	end   bool // a listed prefix ends here
+}
+
+func (t *trieNode) insert(n *net.IPNet) {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	ip := n.IP.To16()
+	for i := 0; i < ones && !t.end; i++ {
+		b := ip[i/8] >> (7 - i%8) & 1
+		if t.child[b] == nil {
+			t.child[b] = &trieNode{}
+		}
+		t = t.child[b]
+	}
+	t.end = true
+}
+
+func (t *trieNode) contains(ip net.IP) bool {
+	ip = ip.To16()
+	for i := 0; t != nil; i++ {
+		if t.end {
+			return true
+		}
+		if i == 128 {
+			return false
+		}
+		t = t.child[ip[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+// "ip" or "cidr" for a listed client, else "". Nil-safe before the first load.
+func (d *denyList) match(ip string) string {
+	if d == nil {
+		return ""
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if d.ips[parsed.String()] {
+		return "ip"
+	}
+	if d.cidr.contains(parsed) {
+		return "cidr"
+	}
+	return ""
+}
+
+// Reloads deny:ip and deny:cidr every interval. Entries that don't parse
+// are skipped with a warning (once per change); a failed read keeps the
+// last list.
+func refreshDenyList(every time.Duration) {
+	var lastBad string
+	for {
+		pipe := redisClient.Pipeline()
+		ipsCmd := pipe.SMembers(ctx, "deny:ip")
+		cidrCmd := pipe.SMembers(ctx, "deny:cidr")
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			log.Printf("[WARN] Reading deny list: %v; keeping the previous one", err)
+		} else {
+			d := &denyList{ips: map[string]bool{}, cidr: &trieNode{}}
+			var bad []string
+			for _, v := range ipsCmd.Val() {
+				if ip := net.ParseIP(strings.TrimSpace(v)); ip != nil {
+					d.ips[ip.String()] = true
+				} else {
+					bad = append(bad, v)
+				}
+			}
+			nets := 0
+			for _, v := range cidrCmd.Val() {
+				if _, n, err := net.ParseCIDR(strings.TrimSpace(v)); err == nil {
+					d.cidr.insert(n)
+					nets++
+				} else {
+					bad = append(bad, v)
+				}
+			}
+			if b := fmt.Sprintf("%q", bad); len(bad) > 0 && b != lastBad {
+				log.Printf("[WARN] Skipping %d unparsable deny list entries: %q", len(bad), bad)
+			}
+			lastBad = fmt.Sprintf("%q", bad)
+			denyEntries.WithLabelValues("ip").Set(float64(len(d.ips)))
+			denyEntries.WithLabelValues("cidr").Set(float64(nets))
+			denied.Store(d)
+		}
+		time.Sleep(every)
+	}
+}
+
+// Active health: a TCP connect per upstream every interval. Success puts an
+// upstream (back) in rotation, failure takes it out.
+func probeUpstreams(interval, timeout time.Duration) {
+	for {
+		for _, up := range upstreams {
+			addr := up.url.Host
+			if up.url.Port() == "" {
+				port := "80"
+				if up.url.Scheme == "https" {
+					port = "443"
+				}
+				addr = net.JoinHostPort(up.url.Hostname(), port)
+			}
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err == nil {
+				_ = conn.Close()
+			}
+			if up.setHealthy(err == nil) {
+				if err == nil {
+					log.Printf("[UPSTREAM] %s back up", up.url.Host)
+				} else {
+					log.Printf("[UPSTREAM] %s marked down by probe: %v", up.url.Host, err)
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// The upstream transport plus metrics
+type timedTransport struct {
+	http.RoundTripper
+}
+
+// Cause of a request the Director refused: its upstream host or SNI
+// override isn't in UPSTREAM_HOST_ALLOWLIST
+var errUpstreamNotAllowed = errors.New("upstream host not allowed")
+
+// Meters the upstream alone, apart from geo/Redis time in the handler.
+// The clock stops at response headers, so streamed bodies don't skew it;
+// upgrades are left out of the histogram since a 101 says nothing about
+// upstream speed.
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The UPSTREAM_REQUEST_TIMEOUT deadline covers the body too, so it is
+	// released when ReverseProxy closes the body, or here on failure. Only
+	// plain requests carry one, so upgrade bodies are never wrapped.
+	cancel, bounded := req.Context().Value(deadlineCancelCtxKey{}).(context.CancelFunc)
+	if !bounded {
+		cancel = func() {}
+	}
+	// Refused by the Director: not an upstream round trip at all
+	if err := context.Cause(req.Context()); err != nil {
+		cancel()
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		cancel()
+		upstreamResponses.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	if bounded {
+		resp.Body = cancelOnClose{resp.Body, cancel}
+	}
+	upstreamResponses.WithLabelValues(fmt.Sprintf("%dxx", resp.StatusCode/100)).Inc()
+	if !isUpgrade(req) {
+		upstreamSeconds.Observe(time.Since(start).Seconds())
+	}
+	return resp, nil
+}
+
+// A response body that releases its request's deadline once closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Upstream transport tuning, from the UPSTREAM_*_TIMEOUT and
+// UPSTREAM_MAX_IDLE_CONNS envs
+type transportConfig struct {
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	respHeaderTimeout   time.Duration
+	idleTimeout         time.Duration
+	maxIdleConns        int
+}
+
 // Build an upstream transport that:
 // - disables HTTP/2 (WebSocket Upgrade stays on HTTP/1.1)
 // - injects SNI per request via context
 // - has no overall request timeout (long-lived WS)
 // - sets conservative, sane dial/idle timeouts
-func newUpstreamTransport(skipVerify bool) *http.Transport {
+func newUpstreamTransport(c *Config) *http.Transport {
+	tc := c.Transport
 	baseTLS := &tls.Config{
-		InsecureSkipVerify: skipVerify,           // set false when proper CA is mounted
+		InsecureSkipVerify: c.SkipTLSVerify,      // set false when proper CA is mounted
 		NextProtos:         []string{"http/1.1"}, // advertise h1 only
 		MinVersion:         tls.VersionTLS12,
 	}
 
 	dialer := &net.Dialer{
-		Timeout:   15 * time.Second,
+		Timeout:   tc.dialTimeout,
 		KeepAlive: 60 * time.Second,
 	}
 
 	tr := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		DialContext:         dialer.DialContext,
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, stop := requestBound(ctx)
+			defer stop()
+			return dialer.DialContext(ctx, network, addr)
+		},
 		ForceAttemptHTTP2:   false,                                                  // disable h2
 		TLSNextProto:        map[string]func(string, *tls.Conn) http.RoundTripper{}, // no h2
-		MaxIdleConns:        512,
-		IdleConnTimeout:     120 * time.Second,
-		TLSHandshakeTimeout: 15 * time.Second,
+		MaxIdleConns:        tc.maxIdleConns,
+		IdleConnTimeout:     tc.idleTimeout,
+		TLSHandshakeTimeout: tc.tlsHandshakeTimeout,
 		// ResponseHeaderTimeout: applies only to headers. Keep modest to not hang handshakes:
-		ResponseHeaderTimeout: 15 * time.Second,
+		ResponseHeaderTimeout: tc.respHeaderTimeout,
 		// DisableCompression: false (fine; WS frames are not affected)
 	}
 
 	// Per-request SNI injection for TLS
 	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, stop := requestBound(ctx)
+		defer stop()
 		raw, err := dialer.DialContext(ctx, network, addr)
 		if err != nil {
 			return nil, err
@@ -339,8 +2450,13 @@ func newUpstreamTransport(skipVerify bool) *http.Transport {
 		cfg := baseTLS.Clone()
 		cfg.ServerName = serverName
 
+		// HandshakeContext, not Handshake: an aborted inbound request must
+		// tear down a stalled handshake too. The Transport doesn't apply
+		// TLSHandshakeTimeout to a custom DialTLSContext, so bound it here.
+		hsCtx, cancel := context.WithTimeout(ctx, tc.tlsHandshakeTimeout)
+		defer cancel()
 		tlsConn := tls.Client(raw, cfg)
-		if err := tlsConn.Handshake(); err != nil {
+		if err := tlsConn.HandshakeContext(hsCtx); err != nil {
 			_ = raw.Close()
 			return nil, fmt.Errorf("tls handshake to %s with SNI=%q failed: %w", addr, serverName, err)
 		}
@@ -350,24 +2466,114 @@ func newUpstreamTransport(skipVerify bool) *http.Transport {
 	return tr
 }
 
+// WebSocket (Connection: Upgrade + Upgrade header) or SSE requests.
+func isLongLived(r *http.Request) bool {
+	return isUpgrade(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The Transport detaches dials from the request's cancellation so a late
+// connection can still serve the next request. For a client that hung up
+// (or hit UPSTREAM_REQUEST_TIMEOUT) we'd rather stop dialing and
+// handshaking at once, so re-attach the dial to the request context the
+// Director recorded. stop must be called once the dial returns.
+func requestBound(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if rc, ok := ctx.Value(requestCtxKey{}).(context.Context); ok {
+		unhook := context.AfterFunc(rc, cancel)
+		return ctx, func() { unhook(); cancel() }
+	}
+	return ctx, cancel
+}
+
 func withSNI(ctx context.Context, sni string) context.Context {
 	return context.WithValue(ctx, sniCtxKey{}, sni)
 }
 
 func desiredSNI(r *http.Request) string {
 	cleanHost := hostNoPort(r.Host)
-	if sniOverride != "" {
-		cleanHost = sniOverride
+	if cfg.SNIOverride != "" {
+		cleanHost = cfg.SNIOverride
 	}
 	return cleanHost
 }
 
 // ---- utils ----
 
-func hashIP(ip string) int {
-	h := fnv.New32a()
-	_, _ = h.Write([]byte(ip))
-	return int(h.Sum32() % 100)
+// Comma-separated CIDRs; a bare IP is taken as a single host.
+func parseCIDRs(k, v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(v, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %v", k, c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipInNets(s string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// REDIS_MODE picks the client: single (default), sentinel or cluster;
+// loadConfig has already rejected anything else.
+func newRedisClient(mode string, opts *redis.UniversalOptions) redis.UniversalClient {
+	switch strings.ToLower(mode) {
+	case "sentinel":
+		return redis.NewFailoverClient(opts.Failover())
+	case "cluster":
+		return redis.NewClusterClient(opts.Cluster())
+	default:
+		return redis.NewClient(opts.Simple())
+	}
+}
+
+// REDIS_ADDRS (comma-separated sentinel or cluster seed nodes), else REDIS_HOST.
+func redisAddrs(host string) []string {
+	var addrs []string
+	for _, a := range strings.Split(getenv("REDIS_ADDRS", ""), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = []string{host}
+	}
+	return addrs
 }
 
 func getenv(k, def string) string {
@@ -377,6 +2583,30 @@ func getenv(k, def string) string {
 	return def
 }
 
+func getenvInt(k string, def int) (int, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: %v", k, v, err)
+	}
+	return n, nil
+}
+
+func getenvDuration(k string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(k)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: %v", k, v, err)
+	}
+	return d, nil
+}
+
 func hostNoPort(h string) string {
 	if h == "" {
 		return h
@@ -8,6 +8,7 @@ require github.com/go-redis/redis/v8 v8.11.5
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/prometheus/client_model v0.6.1 // indirect
 	github.com/prometheus/common v0.62.0 // indirect
@@ -21,3 +22,7 @@ require (
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/prometheus/client_golang v1.22.0
 )
+
+require example.com/alak-common v0.0.0
+
+replace example.com/alak-common => ../alak-common
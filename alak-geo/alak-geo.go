@@ -1,61 +1,549 @@
 package main
 
 import (
+	"bufio"
+	"container/list"
+	"crypto/subtle"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"example.com/alak-common/rules"
 	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type LookupResponse struct {
-	ASN     string `json:"asn"`
-	Country string `json:"country"`
-	TSP     string `json:"tsp"`
-	City    string `json:"city"`
+	rules.Meta // asn, country, tsp, city: what the gatekeeper matches on
+
+	// AS organization as the database spells it; tsp is its NormalizeTSP form
+	Org string `json:"org,omitempty"`
+
+	// Optional detail from the City DB, only returned when asked for via
+	// ?fields=subdivision,postal,... (or ?fields=all)
+	Subdivision    string   `json:"subdivision,omitempty"`
+	Postal         string   `json:"postal,omitempty"`
+	Latitude       *float64 `json:"latitude,omitempty"`
+	Longitude      *float64 `json:"longitude,omitempty"`
+	AccuracyRadius uint16   `json:"accuracy_radius,omitempty"`
+	TimeZone       string   `json:"timezone,omitempty"`
+	Network        string   `json:"network,omitempty"` // ASN DB prefix the IP matched
+	Traits         *Traits  `json:"traits,omitempty"`
 }
 
-var (
-	cityDB        *geoip2.Reader
-	asnDB         *geoip2.Reader
-	tspMap        map[string]string
+// City DB flags useful for abuse filtering (?fields=traits). Set whenever
+// the City DB answered; flags the record lacks stay false.
+type Traits struct {
+	IsAnonymousProxy    bool   `json:"is_anonymous_proxy"`
+	IsSatelliteProvider bool   `json:"is_satellite_provider"`
+	IsAnycast           bool   `json:"is_anycast"`
+	RegisteredCountry   string `json:"registered_country,omitempty"` // where the block is registered, vs. country where it's used
+}
+
+var detailFields = []string{"subdivision", "postal", "latitude", "longitude", "accuracy_radius", "timezone", "network", "traits"}
+
+// Everything the City DB holds for an IP (GET /city), plus the ASN record.
+// cityRecord mirrors geoip2.City field for field so it converts directly;
+// it only adds the snake_case JSON names MaxMind itself uses.
+type CityResponse struct {
+	IP      string `json:"ip"`
+	ASN     string `json:"asn,omitempty"`
+	TSP     string `json:"tsp,omitempty"`
+	Org     string `json:"org,omitempty"`
+	Network string `json:"network,omitempty"` // ASN DB prefix the IP matched
+	cityRecord
+}
+
+type geoNames = map[string]string
+
+type cityRecord struct {
+	City struct {
+		Names     geoNames `json:"names,omitempty"`
+		GeoNameID uint     `json:"geoname_id,omitempty"`
+	} `json:"city"`
+	Postal struct {
+		Code string `json:"code,omitempty"`
+	} `json:"postal"`
+	Continent struct {
+		Names     geoNames `json:"names,omitempty"`
+		Code      string   `json:"code,omitempty"`
+		GeoNameID uint     `json:"geoname_id,omitempty"`
+	} `json:"continent"`
+	Subdivisions []struct {
+		Names     geoNames `json:"names,omitempty"`
+		IsoCode   string   `json:"iso_code,omitempty"`
+		GeoNameID uint     `json:"geoname_id,omitempty"`
+	} `json:"subdivisions"`
+	RepresentedCountry struct {
+		Names             geoNames `json:"names,omitempty"`
+		IsoCode           string   `json:"iso_code,omitempty"`
+		Type              string   `json:"type,omitempty"`
+		GeoNameID         uint     `json:"geoname_id,omitempty"`
+		IsInEuropeanUnion bool     `json:"is_in_european_union"`
+	} `json:"represented_country"`
+	Country struct {
+		Names             geoNames `json:"names,omitempty"`
+		IsoCode           string   `json:"iso_code,omitempty"`
+		GeoNameID         uint     `json:"geoname_id,omitempty"`
+		IsInEuropeanUnion bool     `json:"is_in_european_union"`
+	} `json:"country"`
+	RegisteredCountry struct {
+		Names             geoNames `json:"names,omitempty"`
+		IsoCode           string   `json:"iso_code,omitempty"`
+		GeoNameID         uint     `json:"geoname_id,omitempty"`
+		IsInEuropeanUnion bool     `json:"is_in_european_union"`
+	} `json:"registered_country"`
+	Location struct {
+		TimeZone       string  `json:"time_zone,omitempty"`
+		Latitude       float64 `json:"latitude"`
+		Longitude      float64 `json:"longitude"`
+		MetroCode      uint    `json:"metro_code,omitempty"`
+		AccuracyRadius uint16  `json:"accuracy_radius,omitempty"`
+	} `json:"location"`
+	Traits struct {
+		IsAnonymousProxy    bool `json:"is_anonymous_proxy"`
+		IsAnycast           bool `json:"is_anycast"`
+		IsSatelliteProvider bool `json:"is_satellite_provider"`
+	} `json:"traits"`
+}
+
+var errNoCityDB = errors.New("city database not loaded")
+
+// Immutable once published: reloads build a new snapshot and swap the
+// pointer, so handlers read maps without locking.
+type geoMaps struct {
+	tspMap        map[string][]string // TSP name → every ASN announcing under it
 	asnMap        map[string]LookupResponse
 	asnCountryMap map[string]string
+	asnPrefixes   map[string][]string // ASN → CIDR networks; nil unless ASN_PREFIX_INDEX
+	loadedAt      time.Time
+}
+
+var (
+	// dataMu guards the mmdb readers. IP lookups hold the read lock while
+	// querying so a reload never closes a reader mid-query.
+	dataMu sync.RWMutex
+	cityDB *geoip2.Reader
+	asnDB  *maxminddb.Reader // raw reader: geoip2's ASN() doesn't report the network
+
+	maps atomic.Pointer[geoMaps]
+
+	allowedOrigins []string
+	allowAny       bool
+
+	// BATCH_MAX_IPS caps POST /lookup/batch
+	batchMaxIPs = 1000
+
+	// CIDR_MAX_SAMPLES caps the addresses resolved per GET /lookup?cidr=
+	cidrMaxSamples = 16
+
+	// ASN_COUNTRY_CSV=false skips the CSV-derived ASN→Country map and relies
+	// on the City DB alone (ASN/TSP lookups then carry no country)
+	asnCountryFromCSV = true
+
+	// ASN_PREFIX_INDEX=true keeps every ASN block's network in memory for
+	// GET /asn/prefixes (off by default: roughly one string per CSV row)
+	asnPrefixIndex bool
+
+	// READY_ALLOW_DEGRADED=true: /readyz passes with only one database open
+	readyAllowDegraded bool
+
+	// IP_CACHE_SIZE entries (0 disables), each kept for IP_CACHE_TTL
+	ipCache *lookupCache
+
+	// LOOKUP_MAX_AGE: Cache-Control max-age of successful GET /lookup
+	// answers (0 = no-cache, like errors)
+	lookupMaxAge = 5 * time.Minute
+
+	// ADMIN_TOKEN: bearer token required by POST /reload and /admin/cache/*
+	// (empty = open)
+	adminToken string
+
+	cacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_geo_ip_cache_lookups_total",
+			Help: "IP lookup cache results (hit, miss)",
+		},
+		[]string{"result"},
+	)
+	lookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_geo_lookups_total",
+			Help: "Lookups served by type (ip, cidr, asn, org, tsp, batch, city, prefixes)",
+		},
+		[]string{"type"},
+	)
+	notFound = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_geo_not_found_total",
+			Help: "Lookups that found no data, by type",
+		},
+		[]string{"type"},
+	)
+	dbErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_geo_db_errors_total",
+			Help: "mmdb lookups that failed, by database (city, asn); the other database's fields are still served",
+		},
+		[]string{"db"},
+	)
+	missingCountry = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alak_geo_missing_country_total",
+			Help: "IP lookups answered with an ASN but no country, by type (ip, batch)",
+		},
+		[]string{"type"},
+	)
+	asnsWithoutCountry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "alak_geo_asns_without_country",
+			Help: "ASNs in the loaded data with no CSV-derived or overridden country",
+		},
+	)
+	invalidIPs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "alak_geo_invalid_ip_total",
+			Help: "Requests rejected because the ip parameter did not parse",
+		},
+	)
+	mmdbLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "alak_geo_mmdb_lookup_seconds",
+			Help:    "Latency of the City+ASN mmdb queries for one IP",
+			Buckets: []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01},
+		},
+	)
+
+	// reloadMu serializes reloads (POST /reload and SIGHUP)
+	reloadMu sync.Mutex
+
+	// Data files; defaults match the /data mount, see dataPath
+	cityDBPath     string
+	asnDBPath      string
+	asnBlockFiles  []string // IPv4, IPv6
+	cityBlockFiles []string // IPv4, IPv6
+
+	// ASN_COUNTRY_OVERRIDES: optional "ASN,CC" lines replacing the
+	// CSV-derived country of those ASNs
+	countryOverridesPath string
 )
 
+func init() {
+	prometheus.MustRegister(cacheLookups)
+	prometheus.MustRegister(lookups)
+	prometheus.MustRegister(dbErrors)
+	prometheus.MustRegister(notFound)
+	prometheus.MustRegister(missingCountry)
+	prometheus.MustRegister(asnsWithoutCountry)
+	prometheus.MustRegister(invalidIPs)
+	prometheus.MustRegister(mmdbLatency)
+}
+
+type ReloadResult struct {
+	OK           bool     `json:"ok"`
+	TookMS       int64    `json:"took_ms"`
+	CityDB       bool     `json:"city_db"`
+	ASNDB        bool     `json:"asn_db"`
+	ASNCountries int      `json:"asn_countries"`
+	NoCountry    int      `json:"asns_without_country"`
+	Overrides    int      `json:"asn_country_overrides,omitempty"`
+	TSPRecords   int      `json:"tsp_records"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
 func main() {
-	var err error
-	cityDB, err = geoip2.Open("/data/GeoLite2-City.mmdb")
-	if err != nil {
-		log.Fatalf("failed to open City DB: %v", err)
+	// ---- CORS allow-list from env ----
+	// CORS_ORIGINS="https://dash.example.com,http://localhost:3000"
+	if v := strings.TrimSpace(os.Getenv("CORS_ORIGINS")); v != "" {
+		allowedOrigins = splitAndTrim(v)
+	} else {
+		// Dev default
+		allowedOrigins = []string{"http://localhost:3000"}
 	}
-	defer cityDB.Close()
+	allowAny = len(allowedOrigins) == 1 && allowedOrigins[0] == "*"
 
-	asnDB, err = geoip2.Open("/data/GeoLite2-ASN.mmdb")
-	if err != nil {
-		log.Fatalf("failed to open ASN DB: %v", err)
+	if n, err := strconv.Atoi(os.Getenv("BATCH_MAX_IPS")); err == nil && n > 0 {
+		batchMaxIPs = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("CIDR_MAX_SAMPLES")); err == nil && n > 0 {
+		cidrMaxSamples = n
+	}
+	asnCountryFromCSV = !strings.EqualFold(os.Getenv("ASN_COUNTRY_CSV"), "false")
+	asnPrefixIndex = strings.EqualFold(os.Getenv("ASN_PREFIX_INDEX"), "true")
+	readyAllowDegraded = strings.EqualFold(os.Getenv("READY_ALLOW_DEGRADED"), "true")
+	cacheSize, cacheTTL := 10000, 10*time.Minute
+	if n, err := strconv.Atoi(os.Getenv("IP_CACHE_SIZE")); err == nil && n >= 0 {
+		cacheSize = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("IP_CACHE_TTL")); err == nil && d > 0 {
+		cacheTTL = d
+	}
+	ipCache = newLookupCache(cacheSize, cacheTTL)
+	if d, err := time.ParseDuration(os.Getenv("LOOKUP_MAX_AGE")); err == nil && d >= 0 {
+		lookupMaxAge = d
 	}
-	defer asnDB.Close()
 
-	// Step 1: Build ASN->Country map using only IPv4
-	asnCountryMap = buildASNtoCountry("/data/GeoLite2-ASN-Blocks-IPv4.csv", "/data/GeoLite2-City-Blocks-IPv4.csv")
+	// ADMIN_TOKEN="s3cret" requires "Authorization: Bearer s3cret" on
+	// /reload and /admin/cache/*
+	adminToken = strings.TrimSpace(os.Getenv("ADMIN_TOKEN"))
+	if adminToken == "" {
+		log.Printf("⚠️  ADMIN_TOKEN not set — POST /reload and /admin/cache/* are unauthenticated; keep geo reachable in-cluster only.")
+	}
 
-	// Step 2: Build ASN <-> TSP map
-	loadASNFromCSV("/data/GeoLite2-ASN-Blocks-IPv4.csv")
+	cityDBPath = dataPath("CITY_DB_PATH", "/data/GeoLite2-City.mmdb")
+	asnDBPath = dataPath("ASN_DB_PATH", "/data/GeoLite2-ASN.mmdb")
+	asnBlockFiles = []string{
+		dataPath("ASN_BLOCKS_CSV", "/data/GeoLite2-ASN-Blocks-IPv4.csv"),
+		dataPath("ASN_BLOCKS_CSV_V6", "/data/GeoLite2-ASN-Blocks-IPv6.csv"),
+	}
+	cityBlockFiles = []string{
+		dataPath("CITY_BLOCKS_CSV", "/data/GeoLite2-City-Blocks-IPv4.csv"),
+		dataPath("CITY_BLOCKS_CSV_V6", "/data/GeoLite2-City-Blocks-IPv6.csv"),
+	}
+	if os.Getenv("ASN_COUNTRY_OVERRIDES") != "" {
+		countryOverridesPath = dataPath("ASN_COUNTRY_OVERRIDES", "")
+	}
+
+	// Missing databases degrade lookups instead of killing the process
+	loadData()
+
+	// SIGHUP reloads the same way POST /reload does
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			loadData()
+		}
+	}()
 
-	http.HandleFunc("/lookup", cors(lookupHandler))
+	http.HandleFunc("/lookup", cors(cacheControl(lookupHandler)))
+	http.HandleFunc("/lookup/batch", cors(batchLookupHandler))
+	http.HandleFunc("/city", cors(cityHandler))
+	http.HandleFunc("/asn/prefixes", cors(asnPrefixesHandler))
 	http.HandleFunc("/tsp-list", cors(tspListHandler))
+	http.HandleFunc("/reload", adminOnly(reloadHandler))
+	http.HandleFunc("/admin/cache/flush", adminOnly(cacheFlushHandler))
+	http.HandleFunc("/admin/cache/stats", adminOnly(cacheStatsHandler))
+	http.HandleFunc("/healthz", cors(healthzHandler))
+	http.HandleFunc("/readyz", cors(readyzHandler))
+	http.HandleFunc("/version", cors(versionHandler))
+	http.HandleFunc("/metrics", cors(promhttp.Handler().ServeHTTP))
 
 	port := getenv("PORT", "8081")
 	log.Printf("Alak Geo listening on :%s", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
 
+// Builds fresh readers and maps off to the side, then swaps them in under
+// the write lock. A database that fails to open keeps the previous reader.
+func loadData() ReloadResult {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	start := time.Now()
+	var res ReloadResult
+
+	newCity, err := geoip2.Open(cityDBPath)
+	if err != nil {
+		log.Printf("warn: City DB unavailable: %v", err)
+		res.Errors = append(res.Errors, "city db: "+err.Error())
+	}
+	newASN, err := maxminddb.Open(asnDBPath)
+	if err != nil {
+		log.Printf("warn: ASN DB unavailable: %v", err)
+		res.Errors = append(res.Errors, "asn db: "+err.Error())
+	}
+
+	// Step 1: ASN/TSP maps and ASN->Country map (IPv4 + IPv6)
+	countries, tsps, asns, prefixes, csvErrs := loadCSVMaps(asnCountryFromCSV)
+	for _, err := range csvErrs {
+		log.Printf("error: %v", err)
+		res.Errors = append(res.Errors, "csv: "+err.Error())
+	}
+	if countryOverridesPath != "" {
+		n, err := applyCountryOverrides(countryOverridesPath, countries)
+		if err != nil {
+			log.Printf("error: %v", err)
+			res.Errors = append(res.Errors, "overrides: "+err.Error())
+		}
+		res.Overrides = n
+	}
+
+	// Step 2: ASN records carry the final country, overrides included
+	var noCountry []string
+	for asn, val := range asns {
+		val.Country = countries[asn]
+		asns[asn] = val
+		if val.Country == "" {
+			noCountry = append(noCountry, asn)
+		}
+	}
+	res.NoCountry = len(noCountry)
+	asnsWithoutCountry.Set(float64(len(noCountry)))
+	if len(noCountry) > 0 && asnCountryFromCSV {
+		slices.Sort(noCountry)
+		log.Printf("warn: %d ASNs have no country (no City block matched their prefixes); IPs the City DB can't place get none. Patch via ASN_COUNTRY_OVERRIDES. Sample: %s",
+			len(noCountry), strings.Join(noCountry[:min(len(noCountry), 10)], ", "))
+	}
+
+	dataMu.Lock()
+	oldCity, oldASN := cityDB, asnDB
+	if newCity != nil {
+		cityDB = newCity
+	}
+	if newASN != nil {
+		asnDB = newASN
+	}
+	res.CityDB, res.ASNDB = cityDB != nil, asnDB != nil
+	dataMu.Unlock()
+	maps.Store(&geoMaps{tspMap: tsps, asnMap: asns, asnCountryMap: countries, asnPrefixes: prefixes, loadedAt: time.Now()})
+	ipCache.purge()
+
+	// Safe: no lookup can hold the old readers once the write lock was granted
+	if newCity != nil && oldCity != nil {
+		oldCity.Close()
+	}
+	if newASN != nil && oldASN != nil {
+		oldASN.Close()
+	}
+
+	res.OK = len(res.Errors) == 0
+	res.ASNCountries, res.TSPRecords = len(countries), len(tsps)
+	res.TookMS = time.Since(start).Milliseconds()
+	log.Printf("Geo data loaded in %dms (city_db=%v asn_db=%v asn_countries=%d tsp_records=%d errors=%d)",
+		res.TookMS, res.CityDB, res.ASNDB, res.ASNCountries, res.TSPRecords, len(res.Errors))
+	return res
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res := loadData()
+	w.Header().Set("Content-Type", "application/json")
+	if !res.OK {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ok": true})
+}
+
+// Ready when both readers are open and the CSV maps are populated: "ok",
+// 200. With READY_ALLOW_DEGRADED, one working database is enough:
+// "degraded", 200. Anything else is "unavailable", 503.
+func readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	dataMu.RLock()
+	city, asn := cityDB != nil, asnDB != nil
+	dataMu.RUnlock()
+	m := currentMaps()
+
+	status, code := "ok", http.StatusOK
+	switch {
+	case city && asn && len(m.asnMap) > 0 && len(m.tspMap) > 0:
+	case readyAllowDegraded && (city || asn):
+		status = "degraded"
+	default:
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": status,
+		"components": map[string]any{
+			"city_db":       city,
+			"asn_db":        asn,
+			"asn_records":   len(m.asnMap),
+			"tsp_records":   len(m.tspMap),
+			"asn_countries": len(m.asnCountryMap),
+		},
+	})
+}
+
+// One open mmdb as reported by GET /version
+type dbVersion struct {
+	Path       string    `json:"path"`
+	Type       string    `json:"database_type"`
+	BuildEpoch uint      `json:"build_epoch"`
+	BuildDate  time.Time `json:"build_date"`
+	NodeCount  uint      `json:"node_count"`
+	IPVersion  uint      `json:"ip_version"`
+}
+
+func newDBVersion(path string, md maxminddb.Metadata) *dbVersion {
+	return &dbVersion{
+		Path:       path,
+		Type:       md.DatabaseType,
+		BuildEpoch: md.BuildEpoch,
+		BuildDate:  time.Unix(int64(md.BuildEpoch), 0).UTC(),
+		NodeCount:  md.NodeCount,
+		IPVersion:  md.IPVersion,
+	}
+}
+
+// GET /version: which GeoLite builds are loaded (null if a DB isn't open)
+// and the sizes of the CSV-derived maps, with when they were built.
+func versionHandler(w http.ResponseWriter, _ *http.Request) {
+	var city, asn *dbVersion
+	dataMu.RLock()
+	if cityDB != nil {
+		city = newDBVersion(cityDBPath, cityDB.Metadata())
+	}
+	if asnDB != nil {
+		asn = newDBVersion(asnDBPath, asnDB.Metadata)
+	}
+	dataMu.RUnlock()
+	m := currentMaps()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"city_db": city,
+		"asn_db":  asn,
+		"csv": map[string]any{
+			"loaded_at":     m.loadedAt,
+			"asn_records":   len(m.asnMap),
+			"tsp_records":   len(m.tspMap),
+			"asn_countries": len(m.asnCountryMap),
+		},
+	})
+}
+
+// Path from env k, else def. A path set explicitly must exist (fatal,
+// naming it); a missing default only warns, since every file is optional
+// and lookups degrade without it.
+func dataPath(k, def string) string {
+	p := getenv(k, def)
+	if _, err := os.Stat(p); err != nil {
+		if os.Getenv(k) != "" {
+			log.Fatalf("%s=%s: %v", k, p, err)
+		}
+		log.Printf("warn: %s not found (default %s; set it to override)", p, k)
+	}
+	return p
+}
+
 func getenv(k, d string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
@@ -63,81 +551,250 @@ func getenv(k, d string) string {
 	return d
 }
 
-// Build ASN→Country using only IPv4 CSVs
-func buildASNtoCountry(asnFile, cityFile string) map[string]string {
-	// 1. Load City Blocks: network (CIDR) → country code
-	cityBlockToCountry := map[string]string{}
-	f, _ := os.Open(cityFile)
-	r := csv.NewReader(f)
-	header, _ := r.Read()
-	idxNetwork, idxCountry := -1, -1
-	for i, col := range header {
-		if col == "network" {
-			idxNetwork = i
+// Reads the ASN block CSVs once for both the TSP/ASN maps and, with
+// withCountries, the ASN→Country map, while the city block CSVs load
+// concurrently. Missing or malformed files are skipped, yielding empty (or
+// partial) maps rather than an error. ASN records come back without a
+// country; loadData fills it in once overrides are applied.
+//
+// Memory: networks are held as netKey, country codes as [2]byte and
+// ASNs as uint32 so the intermediates don't pin csv record strings;
+// per-ASN tallies are dropped as soon as their winner is picked.
+func loadCSVMaps(withCountries bool) (countries map[string]string, tsps map[string][]string, asns map[string]LookupResponse, prefixes map[string][]string, errs []error) {
+	var city map[netKey][2]byte
+	var cityErrs []error
+	cityDone := make(chan struct{})
+	if withCountries {
+		go func() {
+			defer close(cityDone)
+			city, cityErrs = loadCityBlocks(cityBlockFiles)
+		}()
+	} else {
+		close(cityDone)
+	}
+
+	tsps, asns, prefixes, blocks, errs := loadASNFromCSV(withCountries, asnBlockFiles...)
+	<-cityDone
+	errs = append(errs, cityErrs...)
+	countries = map[string]string{}
+	if withCountries {
+		countries = tallyASNCountries(blocks, city)
+	}
+	return countries, tsps, asns, prefixes, errs
+}
+
+// Most frequent city-block country across each ASN's networks.
+func tallyASNCountries(blocks []asnBlock, city map[netKey][2]byte) map[string]string {
+	tallies := map[uint32][]countryTally{}
+	for _, b := range blocks {
+		cc, ok := city[b.network]
+		if !ok {
+			continue
+		}
+		t := tallies[b.asn]
+		i := slices.IndexFunc(t, func(t countryTally) bool { return t.cc == cc })
+		if i == -1 {
+			tallies[b.asn] = append(t, countryTally{cc: cc, n: 1})
+			continue
 		}
-		if col == "country_iso_code" {
-			idxCountry = i
+		t[i].n++
+	}
+
+	out := make(map[string]string, len(tallies))
+	for asn, t := range tallies {
+		best := t[0]
+		for _, c := range t[1:] {
+			if c.n > best.n {
+				best = c
+			}
 		}
+		out["AS"+strconv.FormatUint(uint64(asn), 10)] = string(best.cc[:])
+		delete(tallies, asn)
 	}
-	if idxNetwork == -1 || idxCountry == -1 {
-		log.Fatal("GeoLite2-City-Blocks-IPv4.csv missing required columns")
+	log.Printf("Generated ASN→Country map for %d ASNs", len(out))
+	return out
+}
+
+// Reads "ASN,CC" lines (AS prefix optional, "#" comments, blank lines
+// ignored) into countries. The file is all or nothing: one bad line and
+// no override applies, so a typo can't half-apply a correction list.
+func applyCountryOverrides(file string, countries map[string]string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
 	}
-	for {
-		rec, err := r.Read()
-		if err != nil {
-			break
+	defer f.Close()
+
+	parsed := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		asnField, cc, ok := strings.Cut(text, ",")
+		asnField = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(asnField)), "AS")
+		cc = strings.ToUpper(strings.TrimSpace(cc))
+		n, err := strconv.ParseUint(asnField, 10, 32)
+		if !ok || err != nil || len(cc) != 2 || cc[0] < 'A' || cc[0] > 'Z' || cc[1] < 'A' || cc[1] > 'Z' {
+			return 0, fmt.Errorf("%s:%d: want ASN,CC (e.g. AS13335,US), got %q", file, line, sc.Text())
 		}
-		network := rec[idxNetwork]
-		country := strings.ToUpper(rec[idxCountry])
-		if network != "" && country != "" {
-			cityBlockToCountry[network] = country
+		parsed["AS"+strconv.FormatUint(n, 10)] = cc
+	}
+	if err := sc.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", file, err)
+	}
+
+	changed := 0
+	for asn, cc := range parsed {
+		if countries[asn] != cc {
+			changed++
+		}
+		countries[asn] = cc
+	}
+	log.Printf("Applied %d ASN→Country overrides from %s (%d differed from the CSV)", len(parsed), file, changed)
+	return len(parsed), nil
+}
+
+type countryTally struct {
+	cc [2]byte
+	n  uint32
+}
+
+// A CSV network as a map key: the 16-byte address (IPv4 mapped) and the
+// prefix length, half the size of a netip.Prefix
+type netKey [17]byte
+
+func parseNetKey(s string) (k netKey, ok bool) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return k, false
+	}
+	a := p.Addr().As16()
+	copy(k[:16], a[:])
+	k[16] = byte(p.Bits())
+	if p.Addr().Is4() {
+		k[16] += 96
+	}
+	return k, true
+}
+
+// An ASN block network, kept from the single ASN pass until the city
+// blocks are in to tally it against
+type asnBlock struct {
+	network netKey
+	asn     uint32
+}
+
+// City block network → country code, across all files
+func loadCityBlocks(files []string) (map[netKey][2]byte, []error) {
+	into := map[netKey][2]byte{}
+	var errs []error
+	for _, file := range files {
+		err := readCSV(file, []string{"network", "country_iso_code"}, func(rec []string) {
+			country := strings.ToUpper(rec[1])
+			if k, ok := parseNetKey(rec[0]); ok && len(country) == 2 {
+				into[k] = [2]byte{country[0], country[1]}
+			}
+		})
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
-	f.Close()
+	return into, errs
+}
 
-	// 2. Load ASN Blocks and map ASN → countries
-	asnToCountry := map[string]map[string]int{}
-	f, _ = os.Open(asnFile)
-	r = csv.NewReader(f)
-	r.Read() // skip header
+// Streams a MaxMind-style CSV, resolving cols by name from the header row
+// so reordered or added columns don't matter. fn gets the wanted fields in
+// cols order; the slice is reused, so clone anything kept. Malformed rows
+// are skipped and counted; a missing file is only warned about (dataPath
+// already vetted the configured ones), a missing column is an error.
+func readCSV(file string, cols []string, fn func(rec []string)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Printf("warn: cannot open %s: %v; skipping", file, err)
+		return nil
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	r.LazyQuotes = true    // stray quotes inside org names
+	r.FieldsPerRecord = -1 // short rows are skipped below, not fatal
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%s: reading header: %w", file, err)
+	}
+	idx := make([]int, len(cols))
+	for i, col := range cols {
+		idx[i] = slices.IndexFunc(header, func(h string) bool {
+			return strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")) == col
+		})
+		if idx[i] == -1 {
+			return fmt.Errorf("%s: missing column %q (header: %s)", file, col, strings.Join(header, ","))
+		}
+	}
+	need := slices.Max(idx)
+	out := make([]string, len(cols))
+	var bad int
 	for {
 		rec, err := r.Read()
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
-		network := rec[0]
-		asn := "AS" + rec[1]
-		country := cityBlockToCountry[network]
-		if country != "" {
-			if asnToCountry[asn] == nil {
-				asnToCountry[asn] = map[string]int{}
-			}
-			asnToCountry[asn][country]++
+		var perr *csv.ParseError
+		if errors.As(err, &perr) || (err == nil && len(rec) <= need) {
+			bad++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for i, j := range idx {
+			out[i] = rec[j]
 		}
+		fn(out)
 	}
-	f.Close()
+	if bad > 0 {
+		log.Printf("warn: %s: skipped %d malformed rows", file, bad)
+	}
+	return nil
+}
 
-	// 3. Most frequent country per ASN
-	out := map[string]string{}
-	for asn, countries := range asnToCountry {
-		maxC, maxN := "", 0
-		for c, n := range countries {
-			if n > maxN {
-				maxC, maxN = c, n
-			}
-		}
-		if maxC != "" {
-			out[asn] = maxC
+func splitAndTrim(s string) []string {
+	parts := strings.Split(s, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			out = append(out, p)
 		}
 	}
-	log.Printf("Generated ASN→Country map for %d ASNs", len(out))
 	return out
 }
 
+// Exact-match allow-list, same semantics as the controller ("*" reflects any)
+func allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	if allowAny {
+		return origin
+	}
+	for _, a := range allowedOrigins {
+		if a == origin {
+			return origin
+		}
+	}
+	return "null"
+}
+
 func cors(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		if allowed := allowedOrigin(r.Header.Get("Origin")); allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+		}
+		w.Header().Set("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -147,57 +804,456 @@ func cors(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func loadASNFromCSV(file string) {
-	tspMap = make(map[string]string)
-	asnMap = make(map[string]LookupResponse)
-	f, err := os.Open(file)
-	if err != nil {
-		log.Fatalf("warn: cannot open %s: %v", file, err)
+// Requires "Authorization: Bearer <ADMIN_TOKEN>" when a token is set.
+// Without CORS: admin calls come from scripts, never from browsers.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" {
+			auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="alak-geo"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
 	}
-	reader := csv.NewReader(f)
-	reader.Read() // skip header
-	for {
-		rec, err := reader.Read()
-		if err != nil {
-			break
+}
+
+// Sets Cache-Control from the status the handler answers with: max-age
+// (LOOKUP_MAX_AGE) for 200s, no-cache for 400s, 404s and failures, so
+// caches only keep real answers. Bodies are untouched.
+func cacheControl(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&cacheControlWriter{ResponseWriter: w}, r)
+	}
+}
+
+type cacheControlWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (c *cacheControlWriter) WriteHeader(code int) {
+	if !c.wrote {
+		c.wrote = true
+		v := "no-cache"
+		if code == http.StatusOK && lookupMaxAge > 0 {
+			v = fmt.Sprintf("public, max-age=%d", int(lookupMaxAge.Seconds()))
+		}
+		c.Header().Set("Cache-Control", v)
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheControlWriter) Write(b []byte) (int, error) {
+	if !c.wrote {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// With collect, also returns every (network, ASN) row for the country tally.
+func loadASNFromCSV(collect bool, files ...string) (map[string][]string, map[string]LookupResponse, map[string][]string, []asnBlock, []error) {
+	tsps := make(map[string][]string)
+	asns := make(map[string]LookupResponse)
+	var prefixes map[string][]string
+	if asnPrefixIndex {
+		prefixes = make(map[string][]string)
+	}
+	var blocks *[]asnBlock
+	if collect {
+		blocks = new([]asnBlock)
+	}
+	var errs []error
+	for _, file := range files {
+		if err := loadASNBlocks(file, tsps, asns, prefixes, blocks); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	log.Printf("Loaded %d TSP records", len(tsps))
+	if blocks == nil {
+		return tsps, asns, prefixes, nil, errs
+	}
+	return tsps, asns, prefixes, *blocks, errs
+}
+
+// prefixes and blocks may be nil (index disabled, no country tally).
+func loadASNBlocks(file string, tsps map[string][]string, asns map[string]LookupResponse, prefixes map[string][]string, blocks *[]asnBlock) error {
+	cols := []string{"network", "autonomous_system_number", "autonomous_system_organization"}
+	return readCSV(file, cols, func(rec []string) {
+		if blocks != nil {
+			n, nerr := strconv.ParseUint(rec[1], 10, 32)
+			if k, ok := parseNetKey(rec[0]); ok && nerr == nil {
+				*blocks = append(*blocks, asnBlock{network: k, asn: uint32(n)})
+			}
 		}
 		asn := "AS" + rec[1]
-		tsp := strings.ToLower(rec[2])
-		if asn == "AS" || tsp == "" {
-			continue
+		// An ASN spans many rows under one org; normalize it only once
+		if val, seen := asns[asn]; !seen || val.Org != rec[2] {
+			tsp := rules.NormalizeTSP(rec[2])
+			if asn == "AS" || tsp == "" {
+				return
+			}
+			// Clone: rec fields share the whole CSV line's backing string
+			asns[asn] = LookupResponse{Meta: rules.Meta{ASN: asn, TSP: tsp}, Org: strings.Clone(rec[2])}
+			if !slices.Contains(tsps[tsp], asn) {
+				tsps[tsp] = append(tsps[tsp], asn)
+			}
+		}
+		if prefixes != nil {
+			prefixes[asn] = append(prefixes[asn], strings.Clone(rec[0]))
 		}
-		country := asnCountryMap[asn]
-		asnMap[asn] = LookupResponse{ASN: asn, TSP: tsp, Country: country, City: ""}
-		tspMap[tsp] = asn
+	})
+}
+
+func currentMaps() *geoMaps {
+	if m := maps.Load(); m != nil {
+		return m
 	}
-	f.Close()
-	log.Printf("Loaded %d TSP records", len(tspMap))
+	return &geoMaps{}
+}
+
+// Queries the mmdb readers under the read lock. found=false means neither
+// database is loaded; a missing DB leaves its fields empty. The two are
+// queried independently: if one fails its fields stay empty and the error
+// comes back with found=true (a partial answer); only when nothing could
+// be read is it found=false with the error.
+func lookupIP(ip net.IP) (resp LookupResponse, found bool, err error) {
+	dataMu.RLock()
+	defer dataMu.RUnlock()
+	defer prometheus.NewTimer(mmdbLatency).ObserveDuration()
+
+	if cityDB == nil && asnDB == nil {
+		return resp, false, nil
+	}
+	var asnErr, cityErr error
+	if asnDB != nil {
+		var (
+			asnRec  geoip2.ASN
+			network *net.IPNet
+		)
+		asnRec, network, asnErr = lookupASN(ip)
+		if asnErr != nil {
+			dbErrors.WithLabelValues("asn").Inc()
+		} else {
+			fillASN(&resp, asnRec, network)
+		}
+	}
+	if cityDB != nil {
+		var cityRec *geoip2.City
+		cityRec, cityErr = cityDB.City(ip)
+		if cityErr != nil {
+			dbErrors.WithLabelValues("city").Inc()
+		} else {
+			fillCity(&resp, cityRec)
+		}
+	}
+	err = errors.Join(asnErr, cityErr)
+	// Something answered unless every loaded database failed
+	found = (asnDB != nil && asnErr == nil) || (cityDB != nil && cityErr == nil)
+	return resp, found, err
+}
+
+func fillASN(resp *LookupResponse, asnRec geoip2.ASN, network *net.IPNet) {
+	if asnRec.AutonomousSystemNumber != 0 {
+		resp.ASN = "AS" + strconv.Itoa(int(asnRec.AutonomousSystemNumber))
+	}
+	resp.TSP = rules.NormalizeTSP(asnRec.AutonomousSystemOrganization)
+	resp.Org = asnRec.AutonomousSystemOrganization
+	if network != nil {
+		resp.Network = network.String()
+	}
+}
+
+func fillCity(resp *LookupResponse, cityRec *geoip2.City) {
+	resp.Country = cityRec.Country.IsoCode
+	resp.City = cityRec.City.Names["en"]
+	if len(cityRec.Subdivisions) > 0 {
+		resp.Subdivision = cityRec.Subdivisions[0].Names["en"]
+	}
+	resp.Postal = cityRec.Postal.Code
+	if cityRec.Location.Latitude != 0 || cityRec.Location.Longitude != 0 {
+		lat, lon := cityRec.Location.Latitude, cityRec.Location.Longitude
+		resp.Latitude, resp.Longitude = &lat, &lon
+	}
+	resp.AccuracyRadius = cityRec.Location.AccuracyRadius
+	resp.TimeZone = cityRec.Location.TimeZone
+	resp.Traits = &Traits{
+		IsAnonymousProxy:    cityRec.Traits.IsAnonymousProxy,
+		IsSatelliteProvider: cityRec.Traits.IsSatelliteProvider,
+		IsAnycast:           cityRec.Traits.IsAnycast,
+		RegisteredCountry:   cityRec.RegisteredCountry.IsoCode,
+	}
+}
+
+// Parses ?fields= into the set of detail fields to keep; "all" keeps every one
+func parseFields(q string) map[string]bool {
+	keep := map[string]bool{}
+	for _, f := range strings.Split(q, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "all" {
+			for _, d := range detailFields {
+				keep[d] = true
+			}
+		} else if f != "" {
+			keep[f] = true
+		}
+	}
+	return keep
+}
+
+// Clears detail fields the caller didn't ask for so default responses stay small
+func filterFields(resp *LookupResponse, keep map[string]bool) {
+	if !keep["subdivision"] {
+		resp.Subdivision = ""
+	}
+	if !keep["postal"] {
+		resp.Postal = ""
+	}
+	if !keep["latitude"] {
+		resp.Latitude = nil
+	}
+	if !keep["longitude"] {
+		resp.Longitude = nil
+	}
+	if !keep["accuracy_radius"] {
+		resp.AccuracyRadius = 0
+	}
+	if !keep["timezone"] {
+		resp.TimeZone = ""
+	}
+	if !keep["network"] {
+		resp.Network = ""
+	}
+	if !keep["traits"] {
+		resp.Traits = nil
+	}
+}
+
+// ASN record for ip and the network it sits in (nil when the IP isn't in
+// the DB). Callers hold dataMu and have checked asnDB != nil.
+func lookupASN(ip net.IP) (rec geoip2.ASN, network *net.IPNet, err error) {
+	network, ok, err := asnDB.LookupNetwork(ip, &rec)
+	if err != nil || !ok {
+		return rec, nil, err
+	}
+	return rec, network, nil
+}
+
+// lookupIP plus the CSV-derived country fallback, served from the IP cache
+// when possible. Errors and partial answers are never cached; not-found
+// results are.
+func resolveIP(m *geoMaps, ip net.IP) (LookupResponse, bool, error) {
+	key := ip.String()
+	if resp, found, ok := ipCache.get(key); ok {
+		cacheLookups.WithLabelValues("hit").Inc()
+		return resp, found, nil
+	}
+	cacheLookups.WithLabelValues("miss").Inc()
+
+	gen := ipCache.generation()
+	resp, found, err := lookupIP(ip)
+	if err != nil && !found {
+		return resp, found, err
+	}
+	if found && resp.Country == "" && resp.ASN != "" {
+		resp.Country = m.asnCountryMap[resp.ASN]
+	}
+	if err != nil {
+		// Partial (counted in dbErrors): serve it, but let the next lookup
+		// try the failed database again
+		return resp, found, nil
+	}
+	ipCache.put(gen, key, resp, found)
+	return resp, found, nil
+}
+
+/* ------------------------------- IP cache ------------------------------- */
+
+// Small LRU with per-entry TTL. The data only changes on reload, which
+// purges it; the generation check keeps lookups that straddle a reload
+// from re-inserting stale results.
+type lookupCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	gen   uint64
+	ll    *list.List
+	items map[string]*list.Element
+
+	hits, misses uint64 // since start, for GET /admin/cache/stats
+}
+
+type cacheEntry struct {
+	key     string
+	resp    LookupResponse
+	found   bool
+	expires time.Time
+}
+
+func newLookupCache(size int, ttl time.Duration) *lookupCache {
+	return &lookupCache{size: size, ttl: ttl, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *lookupCache) get(key string) (LookupResponse, bool, bool) {
+	if c.size <= 0 {
+		return LookupResponse{}, false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return LookupResponse{}, false, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.misses++
+		return LookupResponse{}, false, false
+	}
+	c.ll.MoveToFront(el)
+	c.hits++
+	return e.resp, e.found, true
+}
+
+func (c *lookupCache) put(gen uint64, key string, resp LookupResponse, found bool) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, resp: resp, found: found, expires: time.Now().Add(c.ttl)})
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *lookupCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Empties the cache; returns how many entries it held. Lookups already
+// running when it's called won't put their (possibly stale) answers back.
+func (c *lookupCache) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.gen++
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+	return n
+}
+
+type cacheStats struct {
+	Enabled  bool    `json:"enabled"`
+	Size     int     `json:"size"`
+	Capacity int     `json:"capacity"`
+	TTL      string  `json:"ttl"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"` // hits / (hits + misses); 0 before any lookup
+}
+
+func (c *lookupCache) stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := cacheStats{Enabled: c.size > 0, Size: c.ll.Len(), Capacity: c.size, TTL: c.ttl.String(), Hits: c.hits, Misses: c.misses}
+	if total := c.hits + c.misses; total > 0 {
+		st.HitRatio = float64(c.hits) / float64(total)
+	}
+	return st
+}
+
+// POST /admin/cache/flush[?cache=ip|all]: empties the IP cache without
+// reloading the databases, e.g. after fixing an overrides file upstream
+// of a test. Answers {"flushed":{"ip":<entries dropped>}}.
+func cacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Query().Get("cache") {
+	case "", "all", "ip":
+	default:
+		http.Error(w, `cache must be "ip" or "all"`, http.StatusBadRequest)
+		return
+	}
+	n := ipCache.purge()
+	log.Printf("IP cache flushed (%d entries)", n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"flushed": map[string]int{"ip": n}})
+}
+
+// GET /admin/cache/stats: {"ip":{size, capacity, ttl, hits, misses, hit_ratio}}
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]cacheStats{"ip": ipCache.stats()})
 }
 
 func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	m := currentMaps()
+
 	// 1) IP-based lookup
 	if ipStr := r.URL.Query().Get("ip"); ipStr != "" {
+		lookups.WithLabelValues("ip").Inc()
 		ip := net.ParseIP(ipStr)
 		if ip == nil {
+			invalidIPs.Inc()
 			http.Error(w, "invalid ip", http.StatusBadRequest)
 			return
 		}
-		cityRec, cErr := cityDB.City(ip)
-		asnRec, aErr := asnDB.ASN(ip)
-		if cErr != nil || aErr != nil {
+		resp, found, err := resolveIP(m, ip)
+		if err != nil {
 			http.Error(w, "GeoIP lookup failed", http.StatusInternalServerError)
 			return
 		}
-		asn := "AS" + strconv.Itoa(int(asnRec.AutonomousSystemNumber))
-		country := cityRec.Country.IsoCode
-		if country == "" {
-			country = asnCountryMap[asn]
+		if !found {
+			notFound.WithLabelValues("ip").Inc()
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
 		}
-		resp := LookupResponse{
-			ASN:     asn,
-			Country: country,
-			TSP:     strings.ToLower(asnRec.AutonomousSystemOrganization),
-			City:    cityRec.City.Names["en"],
+		if resp.Country == "" && resp.ASN != "" {
+			missingCountry.WithLabelValues("ip").Inc()
+		}
+		filterFields(&resp, parseFields(r.URL.Query().Get("fields")))
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	// 1b) Prefix lookup: majority vote over sampled addresses
+	if cidr := r.URL.Query().Get("cidr"); cidr != "" {
+		lookups.WithLabelValues("cidr").Inc()
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			http.Error(w, "invalid cidr", http.StatusBadRequest)
+			return
+		}
+		resp, err := resolveCIDR(m, network)
+		if err != nil {
+			http.Error(w, "GeoIP lookup failed", http.StatusInternalServerError)
+			return
+		}
+		if resp.Found == 0 {
+			notFound.WithLabelValues("cidr").Inc()
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
 		}
 		json.NewEncoder(w).Encode(resp)
 		return
@@ -205,25 +1261,107 @@ func lookupHandler(w http.ResponseWriter, r *http.Request) {
 
 	// 2) ASN exact lookup
 	if asnQ := strings.ToUpper(r.URL.Query().Get("asn")); asnQ != "" {
-		if val, ok := asnMap[asnQ]; ok {
-			val.Country = asnCountryMap[asnQ]
+		lookups.WithLabelValues("asn").Inc()
+		if val, ok := m.asnMap[asnQ]; ok {
+			val.Country = m.asnCountryMap[asnQ]
 			json.NewEncoder(w).Encode(val)
 			return
 		}
+		notFound.WithLabelValues("asn").Inc()
 	}
 
-	// 3) TSP partial lookup
-	if tspQ := strings.ToLower(r.URL.Query().Get("tsp")); tspQ != "" {
+	// 2b) Organization search over the raw AS organization names: every
+	// matching ASN, exact then prefix then substring, ?limit= (default 100)
+	if orgQ := strings.Join(strings.Fields(strings.ToLower(r.URL.Query().Get("org"))), " "); orgQ != "" {
+		lookups.WithLabelValues("org").Inc()
+		limit := 100
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			limit = n
+		}
+		type orgMatch struct {
+			resp LookupResponse
+			rank int
+		}
+		var found []orgMatch
+		for asn, val := range m.asnMap {
+			org := strings.Join(strings.Fields(strings.ToLower(val.Org)), " ")
+			rank := 2
+			switch {
+			case org == orgQ:
+				rank = 0
+			case strings.HasPrefix(org, orgQ):
+				rank = 1
+			case !strings.Contains(org, orgQ):
+				continue
+			}
+			val.Country = m.asnCountryMap[asn]
+			found = append(found, orgMatch{val, rank})
+		}
+		if len(found) == 0 {
+			notFound.WithLabelValues("org").Inc()
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		slices.SortFunc(found, func(a, b orgMatch) int {
+			if a.rank != b.rank {
+				return a.rank - b.rank
+			}
+			if c := strings.Compare(a.resp.Org, b.resp.Org); c != 0 {
+				return c
+			}
+			an, _ := strconv.Atoi(strings.TrimPrefix(a.resp.ASN, "AS"))
+			bn, _ := strconv.Atoi(strings.TrimPrefix(b.resp.ASN, "AS"))
+			return an - bn
+		})
+		matches := make([]LookupResponse, 0, min(limit, len(found)))
+		for _, f := range found[:min(limit, len(found))] {
+			matches = append(matches, f.resp)
+		}
+		json.NewEncoder(w).Encode(matches)
+		return
+	}
+
+	// 3) TSP search, best match first (see rankTSP); ?limit= caps the list
+	// Normalized like the names it searches, so "Comcast, LLC" still hits
+	if tspQ := rules.NormalizeTSP(r.URL.Query().Get("tsp")); tspQ != "" {
+		lookups.WithLabelValues("tsp").Inc()
+		qTokens := strings.Fields(tspQ)
+		var ranked []tspMatch
+		for tsp := range m.tspMap {
+			if rank, overlap, ok := rankTSP(tsp, tspQ, qTokens); ok {
+				ranked = append(ranked, tspMatch{tsp, rank, overlap})
+			}
+		}
+		slices.SortFunc(ranked, func(a, b tspMatch) int {
+			if a.rank != b.rank {
+				return a.rank - b.rank
+			}
+			if a.overlap != b.overlap {
+				return b.overlap - a.overlap
+			}
+			if len(a.tsp) != len(b.tsp) {
+				return len(a.tsp) - len(b.tsp)
+			}
+			return strings.Compare(a.tsp, b.tsp)
+		})
 		var matches []LookupResponse
-		for tsp, asn := range tspMap {
-			if strings.Contains(tsp, tspQ) {
-				val := asnMap[asn]
-				val.Country = asnCountryMap[asn]
+		for _, t := range ranked {
+			for _, asn := range m.tspMap[t.tsp] {
+				val := m.asnMap[asn]
+				val.TSP = t.tsp
+				val.Country = m.asnCountryMap[asn]
 				matches = append(matches, val)
 			}
 		}
-		switch len(matches) {
+		// Single ASN keeps the legacy object shape; anything more is a 300
+		// list, even when limit trims it to one entry
+		total := len(matches)
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			matches = matches[:min(n, total)]
+		}
+		switch total {
 		case 0:
+			notFound.WithLabelValues("tsp").Inc()
 			http.Error(w, "Not found", http.StatusNotFound)
 		case 1:
 			json.NewEncoder(w).Encode(matches[0])
@@ -237,9 +1375,285 @@ func lookupHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Invalid query", http.StatusBadRequest)
 }
 
+// GET /lookup?cidr=: the majority ASN (with its TSP) and country among
+// the sampled addresses. Confidence is the majority's share of all samples,
+// so addresses with no data count against it.
+type CIDRResponse struct {
+	CIDR              string  `json:"cidr"`
+	ASN               string  `json:"asn"`
+	TSP               string  `json:"tsp"`
+	Country           string  `json:"country"`
+	Sampled           int     `json:"sampled"`
+	Found             int     `json:"found"`
+	ASNConfidence     float64 `json:"asn_confidence"`
+	CountryConfidence float64 `json:"country_confidence"`
+}
+
+// Up to max addresses spread evenly over the prefix, first and last
+// address included. Small prefixes are resolved address by address.
+func sampleCIDR(network *net.IPNet, max int) []net.IP {
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	n := max
+	if size.IsInt64() && size.Int64() < int64(n) {
+		n = int(size.Int64())
+	}
+	base := new(big.Int).SetBytes(network.IP)
+	last := new(big.Int).Sub(size, big.NewInt(1))
+	out := make([]net.IP, 0, n)
+	for i := 0; i < n; i++ {
+		off := new(big.Int)
+		if n > 1 {
+			off.Mul(last, big.NewInt(int64(i))).Div(off, big.NewInt(int64(n-1)))
+		}
+		out = append(out, net.IP(off.Add(off, base).FillBytes(make([]byte, bits/8))))
+	}
+	return out
+}
+
+// Resolves each sample through resolveIP (so the IP cache applies) and
+// votes. Ties go to the value seen first, i.e. nearest the network address.
+func resolveCIDR(m *geoMaps, network *net.IPNet) (CIDRResponse, error) {
+	out := CIDRResponse{CIDR: network.String()}
+	asnVotes, countryVotes := map[string]int{}, map[string]int{}
+	tspOf := map[string]string{}
+	var asnOrder, countryOrder []string
+	var failed int
+	for _, ip := range sampleCIDR(network, cidrMaxSamples) {
+		out.Sampled++
+		resp, found, err := resolveIP(m, ip)
+		if err != nil {
+			failed++
+			continue
+		}
+		if !found {
+			continue
+		}
+		out.Found++
+		if resp.ASN != "" {
+			if asnVotes[resp.ASN] == 0 {
+				asnOrder = append(asnOrder, resp.ASN)
+				tspOf[resp.ASN] = resp.TSP
+			}
+			asnVotes[resp.ASN]++
+		}
+		if resp.Country != "" {
+			if countryVotes[resp.Country] == 0 {
+				countryOrder = append(countryOrder, resp.Country)
+			}
+			countryVotes[resp.Country]++
+		}
+	}
+	if failed == out.Sampled {
+		return out, errors.New("every sampled lookup failed")
+	}
+	for _, asn := range asnOrder {
+		if asnVotes[asn] > asnVotes[out.ASN] {
+			out.ASN = asn
+		}
+	}
+	for _, c := range countryOrder {
+		if countryVotes[c] > countryVotes[out.Country] {
+			out.Country = c
+		}
+	}
+	out.TSP = tspOf[out.ASN]
+	out.ASNConfidence = float64(asnVotes[out.ASN]) / float64(out.Sampled)
+	out.CountryConfidence = float64(countryVotes[out.Country]) / float64(out.Sampled)
+	return out, nil
+}
+
+type tspMatch struct {
+	tsp           string
+	rank, overlap int
+}
+
+// How well a normalized TSP name matches query q: rank 0 exact, 1 prefix,
+// 2 substring, 3 sharing whole words only (overlap counts them). ok is
+// false for names that share nothing.
+func rankTSP(name, q string, qTokens []string) (rank, overlap int, ok bool) {
+	switch {
+	case name == q:
+		return 0, 0, true
+	case strings.HasPrefix(name, q):
+		return 1, 0, true
+	case strings.Contains(name, q):
+		return 2, 0, true
+	}
+	for _, t := range strings.Fields(name) {
+		if slices.Contains(qTokens, t) {
+			overlap++
+		}
+	}
+	return 3, overlap, overlap > 0
+}
+
+type BatchEntry struct {
+	IP string `json:"ip"`
+	LookupResponse
+	Error string `json:"error,omitempty"`
+}
+
+// Full City (and ASN) record for one IP. Unlike lookupIP this skips the
+// cache and country fallback: it shows exactly what the databases say.
+func cityDetail(ip net.IP) (resp CityResponse, found bool, err error) {
+	dataMu.RLock()
+	defer dataMu.RUnlock()
+
+	if cityDB == nil {
+		return resp, false, errNoCityDB
+	}
+	rec, err := cityDB.City(ip)
+	if err != nil {
+		return resp, false, err
+	}
+	resp.IP = ip.String()
+	resp.cityRecord = cityRecord(*rec)
+	if asnDB != nil {
+		if asnRec, network, err := lookupASN(ip); err == nil && asnRec.AutonomousSystemNumber != 0 {
+			resp.ASN = "AS" + strconv.Itoa(int(asnRec.AutonomousSystemNumber))
+			resp.TSP = rules.NormalizeTSP(asnRec.AutonomousSystemOrganization)
+			resp.Org = asnRec.AutonomousSystemOrganization
+			resp.Network = network.String()
+		}
+	}
+	found = rec.Continent.Code != "" || rec.Country.IsoCode != "" || rec.RegisteredCountry.IsoCode != ""
+	return resp, found, nil
+}
+
+func cityHandler(w http.ResponseWriter, r *http.Request) {
+	lookups.WithLabelValues("city").Inc()
+	ipStr := r.URL.Query().Get("ip")
+	if ipStr == "" {
+		http.Error(w, "ip required", http.StatusBadRequest)
+		return
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		invalidIPs.Inc()
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+	resp, found, err := cityDetail(ip)
+	if errors.Is(err, errNoCityDB) {
+		http.Error(w, "City database not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "GeoIP lookup failed", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		notFound.WithLabelValues("city").Inc()
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GET /asn/prefixes?asn=AS123[&offset=0&limit=100]: the ASN's CIDR blocks
+// from the CSV, paginated.
+func asnPrefixesHandler(w http.ResponseWriter, r *http.Request) {
+	lookups.WithLabelValues("prefixes").Inc()
+	m := currentMaps()
+	if m.asnPrefixes == nil {
+		http.Error(w, "prefix index disabled (set ASN_PREFIX_INDEX=true)", http.StatusNotImplemented)
+		return
+	}
+	q := r.URL.Query()
+	asn := strings.ToUpper(strings.TrimSpace(q.Get("asn")))
+	if asn == "" {
+		http.Error(w, "asn required", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(asn, "AS") {
+		asn = "AS" + asn
+	}
+	all, ok := m.asnPrefixes[asn]
+	if !ok {
+		notFound.WithLabelValues("prefixes").Inc()
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	offset, limit := 0, 100
+	if n, err := strconv.Atoi(q.Get("offset")); err == nil && n > 0 {
+		offset = n
+	}
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = min(n, 1000)
+	}
+	page := all[min(offset, len(all)):min(offset+limit, len(all))]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"asn":      asn,
+		"total":    len(all),
+		"offset":   offset,
+		"limit":    limit,
+		"prefixes": page,
+	})
+}
+
+// POST /lookup/batch with a JSON array of IPs. The response array is
+// index-aligned with the request; bad or unknown IPs carry an error.
+func batchLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(batchMaxIPs)*64+1024)
+	var ips []string
+	if err := json.NewDecoder(r.Body).Decode(&ips); err != nil {
+		http.Error(w, "Invalid JSON: expected an array of IP strings", http.StatusBadRequest)
+		return
+	}
+	if len(ips) > batchMaxIPs {
+		http.Error(w, fmt.Sprintf("batch too large: %d > %d", len(ips), batchMaxIPs), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	m := currentMaps()
+	keep := parseFields(r.URL.Query().Get("fields"))
+	out := make([]BatchEntry, len(ips))
+	lookups.WithLabelValues("batch").Add(float64(len(ips)))
+	for i, ipStr := range ips {
+		out[i].IP = ipStr
+		ip := net.ParseIP(strings.TrimSpace(ipStr))
+		if ip == nil {
+			invalidIPs.Inc()
+			out[i].Error = "invalid ip"
+			continue
+		}
+		resp, found, err := resolveIP(m, ip)
+		switch {
+		case err != nil:
+			out[i].Error = "GeoIP lookup failed"
+		case !found:
+			notFound.WithLabelValues("batch").Inc()
+			out[i].Error = "not found"
+		default:
+			if resp.Country == "" && resp.ASN != "" {
+				missingCountry.WithLabelValues("batch").Inc()
+			}
+			filterFields(&resp, keep)
+			out[i].LookupResponse = resp
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /tsp-list returns TSP names; ?asns=true returns {tsp: [asn, ...]} instead
 func tspListHandler(w http.ResponseWriter, r *http.Request) {
+	m := currentMaps()
+	if strings.EqualFold(r.URL.Query().Get("asns"), "true") {
+		json.NewEncoder(w).Encode(m.tspMap)
+		return
+	}
 	var list []string
-	for tsp := range tspMap {
+	for tsp := range m.tspMap {
 		list = append(list, tsp)
 	}
 	json.NewEncoder(w).Encode(list)
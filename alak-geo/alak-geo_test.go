@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Points the loader at the bundled mmdbs and small CSVs in a temp dir, and
+// loads them once.
+func testData(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	cityDBPath = filepath.Join("geoip", "GeoLite2-City.mmdb")
+	asnDBPath = filepath.Join("geoip", "GeoLite2-ASN.mmdb")
+	asnBlockFiles = []string{write("asn.csv", "network,autonomous_system_number,autonomous_system_organization\n"+
+		"1.0.0.0/24,13335,CLOUDFLARENET\n"+
+		"1.1.1.0/24,13335,CLOUDFLARENET\n"+
+		"8.8.8.0/24,15169,GOOGLE\n")}
+	cityBlockFiles = []string{write("city.csv", "network,geoname_id,country_iso_code\n"+
+		"1.0.0.0/24,2077456,AU\n"+
+		"1.1.1.0/24,2077456,AU\n"+
+		"8.8.8.0/24,6252001,US\n")}
+	asnCountryFromCSV, asnPrefixIndex = true, true
+	ipCache = newLookupCache(100, time.Minute)
+	if res := loadData(); !res.OK {
+		t.Fatalf("loadData: %v", res.Errors)
+	}
+}
+
+// Lookups racing reloads must always see a whole snapshot: run with -race.
+func TestLookupDuringReload(t *testing.T) {
+	testData(t)
+
+	queries := []string{
+		"/lookup?ip=1.1.1.1",
+		"/lookup?ip=8.8.8.8",
+		"/lookup?asn=AS13335",
+		"/lookup?tsp=google",
+		"/lookup?org=cloudflare",
+		"/lookup?cidr=1.0.0.0/30",
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				q := queries[(i+n)%len(queries)]
+				w := httptest.NewRecorder()
+				lookupHandler(w, httptest.NewRequest(http.MethodGet, q, nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("%s: status %d: %s", q, w.Code, w.Body)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		reloadHandler(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("reload %d: status %d: %s", i, w.Code, w.Body)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestReloadRequiresAdminToken(t *testing.T) {
+	testData(t)
+	adminToken = "s3cret"
+	t.Cleanup(func() { adminToken = "" })
+	h := adminOnly(reloadHandler)
+
+	for _, auth := range []string{"", "Bearer wrong", "s3cret", "Basic s3cret"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		h(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", auth, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/reload", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	h(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("right token: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCacheStatsAndFlush(t *testing.T) {
+	testData(t)
+	stats := func() cacheStats {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cacheStatsHandler(w, httptest.NewRequest(http.MethodGet, "/admin/cache/stats", nil))
+		var out map[string]cacheStats
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatalf("stats: %v: %s", err, w.Body)
+		}
+		return out["ip"]
+	}
+	for _, q := range []string{"/lookup?ip=1.1.1.1", "/lookup?ip=1.1.1.1", "/lookup?ip=1.1.1.1", "/lookup?ip=8.8.8.8"} {
+		lookupHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, q, nil))
+	}
+	st := stats()
+	if !st.Enabled || st.Size != 2 || st.Capacity != 100 || st.Hits != 2 || st.Misses != 2 || st.HitRatio != 0.5 {
+		t.Errorf("stats after 2 misses, 2 hits: %+v", st)
+	}
+
+	w := httptest.NewRecorder()
+	cacheFlushHandler(w, httptest.NewRequest(http.MethodPost, "/admin/cache/flush?cache=nope", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("cache=nope: status %d, want 400", w.Code)
+	}
+	w = httptest.NewRecorder()
+	cacheFlushHandler(w, httptest.NewRequest(http.MethodPost, "/admin/cache/flush", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"flushed":{"ip":2}}` {
+		t.Errorf("flush: %d %s", w.Code, w.Body)
+	}
+	if st := stats(); st.Size != 0 || st.Hits != 2 {
+		t.Errorf("stats after flush: %+v; want size 0, counts kept", st)
+	}
+	lookupHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/lookup?ip=1.1.1.1", nil))
+	if st := stats(); st.Misses != 3 {
+		t.Errorf("lookup after flush: %+v; want a miss", st)
+	}
+}
+
+// Drops the open readers, so a load with missing files can't fall back to
+// the previous ones.
+func closeReaders(t *testing.T) {
+	t.Helper()
+	dataMu.Lock()
+	defer dataMu.Unlock()
+	if cityDB != nil {
+		cityDB.Close()
+	}
+	if asnDB != nil {
+		asnDB.Close()
+	}
+	cityDB, asnDB = nil, nil
+}
+
+func lookup(t *testing.T, q string) (int, LookupResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	lookupHandler(w, httptest.NewRequest(http.MethodGet, q, nil))
+	var resp LookupResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v: %s", q, err, w.Body)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestMissingFiles(t *testing.T) {
+	t.Run("city db", func(t *testing.T) {
+		testData(t)
+		closeReaders(t)
+		cityDBPath = filepath.Join(t.TempDir(), "missing.mmdb")
+		if res := loadData(); res.OK || res.CityDB || !res.ASNDB {
+			t.Errorf("reload: %+v; want not OK, ASN DB only", res)
+		}
+		// ASN from the ASN DB, country from the CSV fallback
+		if code, resp := lookup(t, "/lookup?ip=1.1.1.1"); code != http.StatusOK || resp.ASN != "AS13335" || resp.Country != "AU" {
+			t.Errorf("?ip=1.1.1.1: %d %+v", code, resp)
+		}
+		if code, resp := lookup(t, "/lookup?asn=AS13335"); code != http.StatusOK || resp.Country != "AU" {
+			t.Errorf("?asn=AS13335: %d %+v", code, resp)
+		}
+	})
+
+	t.Run("csvs", func(t *testing.T) {
+		testData(t)
+		dir := t.TempDir()
+		asnBlockFiles = []string{filepath.Join(dir, "asn.csv")}
+		cityBlockFiles = []string{filepath.Join(dir, "city.csv")}
+		loadData()
+		if code, resp := lookup(t, "/lookup?ip=8.8.8.8"); code != http.StatusOK || resp.ASN != "AS15169" || resp.Country != "US" {
+			t.Errorf("?ip=8.8.8.8: %d %+v", code, resp)
+		}
+		if code, _ := lookup(t, "/lookup?tsp=google"); code != http.StatusNotFound {
+			t.Errorf("?tsp=google with no CSV maps: %d, want 404", code)
+		}
+		// An unknown ASN falls through to "Invalid query", as it always has
+		if code, _ := lookup(t, "/lookup?asn=AS15169"); code != http.StatusBadRequest {
+			t.Errorf("?asn=AS15169 with no CSV maps: %d, want 400", code)
+		}
+	})
+
+	t.Run("everything", func(t *testing.T) {
+		testData(t)
+		closeReaders(t)
+		dir := t.TempDir()
+		cityDBPath, asnDBPath = filepath.Join(dir, "city.mmdb"), filepath.Join(dir, "asn.mmdb")
+		asnBlockFiles = []string{filepath.Join(dir, "asn.csv")}
+		cityBlockFiles = []string{filepath.Join(dir, "city.csv")}
+		if res := loadData(); res.OK || res.CityDB || res.ASNDB {
+			t.Errorf("reload: %+v; want nothing loaded", res)
+		}
+		for _, q := range []string{"/lookup?ip=1.1.1.1", "/lookup?ip=2001:4860:4860::8888", "/lookup?tsp=google"} {
+			if code, _ := lookup(t, q); code != http.StatusNotFound {
+				t.Errorf("%s: %d, want 404", q, code)
+			}
+		}
+	})
+}
+
+func TestIPv6Blocks(t *testing.T) {
+	testData(t)
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	asnBlockFiles = append(asnBlockFiles, write("asn6.csv", "network,autonomous_system_number,autonomous_system_organization\n"+
+		"2001:4860::/32,15169,GOOGLE\n"+
+		"2001:470::/32,6939,HURRICANE\n"))
+	cityBlockFiles = append(cityBlockFiles, write("city6.csv", "network,geoname_id,country_iso_code\n"+
+		"2001:470::/32,6252001,US\n"))
+	if res := loadData(); !res.OK {
+		t.Fatalf("loadData: %v", res.Errors)
+	}
+
+	// AS6939 is only in the IPv6 files
+	if code, resp := lookup(t, "/lookup?asn=AS6939"); code != http.StatusOK || resp.TSP != "hurricane" || resp.Country != "US" {
+		t.Errorf("?asn=AS6939: %d %+v", code, resp)
+	}
+	if code, resp := lookup(t, "/lookup?ip=2001:4860:4860::8888"); code != http.StatusOK || resp.ASN != "AS15169" || resp.TSP != "google" {
+		t.Errorf("?ip=2001:4860:4860::8888: %d %+v", code, resp)
+	}
+
+	w := httptest.NewRecorder()
+	asnPrefixesHandler(w, httptest.NewRequest(http.MethodGet, "/asn/prefixes?asn=15169", nil))
+	var out struct{ Prefixes []string }
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("prefixes: %v: %s", err, w.Body)
+	}
+	if !slices.Equal(out.Prefixes, []string{"8.8.8.0/24", "2001:4860::/32"}) {
+		t.Errorf("AS15169 prefixes = %q, want both families", out.Prefixes)
+	}
+
+	// Without the City DB the country comes from the IPv6 City blocks
+	closeReaders(t)
+	cityDBPath = filepath.Join(dir, "missing.mmdb")
+	loadData()
+	if code, resp := lookup(t, "/lookup?ip=2001:470::1"); code != http.StatusOK || resp.ASN != "AS6939" || resp.Country != "US" {
+		t.Errorf("?ip=2001:470::1 without City DB: %d %+v", code, resp)
+	}
+}
+
+func TestTSPSpanningTwoASNs(t *testing.T) {
+	testData(t)
+	path := filepath.Join(t.TempDir(), "asn-extra.csv")
+	if err := os.WriteFile(path, []byte("network,autonomous_system_number,autonomous_system_organization\n"+
+		"1.2.0.0/24,64496,ACME\n"+
+		"1.2.1.0/24,64497,ACME\n"+
+		"1.2.2.0/24,64496,ACME\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	asnBlockFiles = append(asnBlockFiles, path)
+	loadData()
+
+	w := httptest.NewRecorder()
+	lookupHandler(w, httptest.NewRequest(http.MethodGet, "/lookup?tsp=acme", nil))
+	var list []LookupResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("?tsp=acme: %v: %s", err, w.Body)
+	}
+	if w.Code != http.StatusMultipleChoices || len(list) != 2 || list[0].ASN != "AS64496" || list[1].ASN != "AS64497" {
+		t.Errorf("?tsp=acme: %d %+v; want 300 with both ASNs", w.Code, list)
+	}
+
+	// One ASN keeps the single-object shape
+	if code, resp := lookup(t, "/lookup?tsp=cloudflarenet"); code != http.StatusOK || resp.ASN != "AS13335" {
+		t.Errorf("?tsp=cloudflarenet: %d %+v", code, resp)
+	}
+
+	w = httptest.NewRecorder()
+	tspListHandler(w, httptest.NewRequest(http.MethodGet, "/tsp-list?asns=true", nil))
+	var asns map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &asns); err != nil {
+		t.Fatalf("/tsp-list: %v: %s", err, w.Body)
+	}
+	if !slices.Equal(asns["acme"], []string{"AS64496", "AS64497"}) {
+		t.Errorf("/tsp-list acme = %q", asns["acme"])
+	}
+}
+
+// The mmdb at path with its data section overwritten, so every lookup that
+// finds a record fails to decode it.
+func corruptMMDB(t *testing.T, path string) []byte {
+	t.Helper()
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeSize := int(r.Metadata.NodeCount * r.Metadata.RecordSize / 4)
+	end := bytes.LastIndex(buf, []byte("\xAB\xCD\xEFMaxMind.com"))
+	out := slices.Clone(buf)
+	for i := treeSize + 16; i < end; i++ {
+		out[i] = 0xFF // extended type 262: no such type
+	}
+	return out
+}
+
+func TestPartialLookupFailure(t *testing.T) {
+	testData(t)
+	badCity, err := geoip2.FromBytes(corruptMMDB(t, cityDBPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badASN, err := maxminddb.FromBytes(corruptMMDB(t, asnDBPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	goodCity, goodASN := cityDB, asnDB
+	use := func(city *geoip2.Reader, asn *maxminddb.Reader) {
+		dataMu.Lock()
+		cityDB, asnDB = city, asn
+		dataMu.Unlock()
+		ipCache.purge()
+	}
+	t.Cleanup(func() { use(goodCity, goodASN) })
+
+	// ASN reader failing: City fields still served
+	use(goodCity, badASN)
+	before := testutil.ToFloat64(dbErrors.WithLabelValues("asn"))
+	for i := 0; i < 2; i++ {
+		if code, resp := lookup(t, "/lookup?ip=8.8.8.8"); code != http.StatusOK || resp.ASN != "" || resp.Country != "US" {
+			t.Errorf("ASN DB failing, lookup %d: %d %+v; want 200 with country only", i, code, resp)
+		}
+	}
+	// Partial answers aren't cached: both lookups tried the ASN DB again
+	if n := testutil.ToFloat64(dbErrors.WithLabelValues("asn")) - before; n != 2 {
+		t.Errorf("%v ASN DB errors, want 2", n)
+	}
+
+	// City reader failing: ASN fields, and the CSV country for the ASN
+	use(badCity, goodASN)
+	before = testutil.ToFloat64(dbErrors.WithLabelValues("city"))
+	if code, resp := lookup(t, "/lookup?ip=8.8.8.8"); code != http.StatusOK || resp.ASN != "AS15169" || resp.Country != "US" {
+		t.Errorf("City DB failing: %d %+v; want 200 with the ASN and CSV country", code, resp)
+	}
+	if n := testutil.ToFloat64(dbErrors.WithLabelValues("city")) - before; n != 1 {
+		t.Errorf("%v City DB errors, want 1", n)
+	}
+
+	use(badCity, badASN)
+	if code, _ := lookup(t, "/lookup?ip=8.8.8.8"); code != http.StatusInternalServerError {
+		t.Errorf("both failing: %d, want 500", code)
+	}
+}
+
+func TestTSPSearchRanking(t *testing.T) {
+	testData(t)
+	path := filepath.Join(t.TempDir(), "asn-extra.csv")
+	if err := os.WriteFile(path, []byte("network,autonomous_system_number,autonomous_system_organization\n"+
+		"1.2.0.0/24,64501,BRITISH TELECOM\n"+
+		"1.2.1.0/24,64502,TELECOM ARGENTINA\n"+
+		"1.2.2.0/24,64503,TELECOM\n"+
+		"1.2.3.0/24,64504,TELECOM ITALIA\n"+
+		"1.2.4.0/24,64505,MOBILE ITALIA NET\n"+
+		"1.2.5.0/24,64506,ITALIAN TELECOMS\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	asnBlockFiles = append(asnBlockFiles, path)
+	loadData()
+
+	search := func(q string) []string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		lookupHandler(w, httptest.NewRequest(http.MethodGet, "/lookup?"+q, nil))
+		var list []LookupResponse
+		if w.Code != http.StatusMultipleChoices || json.Unmarshal(w.Body.Bytes(), &list) != nil {
+			t.Fatalf("?%s: %d %s, want a 300 list", q, w.Code, w.Body)
+		}
+		var tsps []string
+		for _, m := range list {
+			tsps = append(tsps, m.TSP)
+		}
+		return tsps
+	}
+	for _, tc := range []struct {
+		q    string
+		want []string
+	}{
+		// exact, then prefix (shorter first), then substring
+		{"tsp=telecom", []string{"telecom", "telecom italia", "telecom argentina", "british telecom", "italian telecoms"}},
+		{"tsp=Telecom,%20Inc.", []string{"telecom", "telecom italia", "telecom argentina", "british telecom", "italian telecoms"}},
+		{"tsp=telecom&limit=2", []string{"telecom", "telecom italia"}},
+		// no substring match: more shared words first
+		{"tsp=italia%20mobile", []string{"mobile italia net", "telecom italia"}},
+	} {
+		if got := search(tc.q); !slices.Equal(got, tc.want) {
+			t.Errorf("?%s =\n  %q\nwant\n  %q", tc.q, got, tc.want)
+		}
+	}
+
+	if code, resp := lookup(t, "/lookup?tsp=argentina"); code != http.StatusOK || resp.ASN != "AS64502" {
+		t.Errorf("?tsp=argentina: %d %+v; want the single match", code, resp)
+	}
+}
+
+// An ASN_COUNTRY_OVERRIDES entry wins over the CSV-derived country, in the
+// ASN branch and in the IP branch's fallback.
+func TestCountryOverrideWins(t *testing.T) {
+	testData(t)
+	path := filepath.Join(t.TempDir(), "overrides.csv")
+	if err := os.WriteFile(path, []byte("# anycast, counted as AU by the CSVs\nAS13335,US\n64999,ir\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	countryOverridesPath = path
+	t.Cleanup(func() { countryOverridesPath = "" })
+	if res := loadData(); !res.OK || res.Overrides != 2 {
+		t.Fatalf("reload: %+v; want OK with 2 overrides", res)
+	}
+
+	if code, resp := lookup(t, "/lookup?asn=AS13335"); code != http.StatusOK || resp.Country != "US" {
+		t.Errorf("?asn=AS13335: %d %+v; want the override US over the CSV's AU", code, resp)
+	}
+	// Only the CSVs' ASNs are looked up; an override alone adds none
+	if code, _ := lookup(t, "/lookup?asn=AS64999"); code == http.StatusOK {
+		t.Errorf("?asn=AS64999: %d, want no match", code)
+	}
+
+	closeReaders(t)
+	cityDBPath = filepath.Join(t.TempDir(), "missing.mmdb")
+	loadData()
+	if code, resp := lookup(t, "/lookup?ip=1.1.1.1"); code != http.StatusOK || resp.ASN != "AS13335" || resp.Country != "US" {
+		t.Errorf("?ip=1.1.1.1 without City DB: %d %+v; want the override US", code, resp)
+	}
+
+	if err := os.WriteFile(path, []byte("AS13335,USA\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if res := loadData(); len(res.Errors) == 0 {
+		t.Errorf("reload with a bad override: %+v; want an error", res)
+	}
+}
@@ -4,11 +4,26 @@ go 1.23
 
 toolchain go1.23.4
 
-require github.com/oschwald/geoip2-golang v1.13.0
+require (
+	github.com/oschwald/geoip2-golang v1.13.0
+	github.com/oschwald/maxminddb-golang v1.13.0
+	github.com/prometheus/client_golang v1.22.0
+)
 
 require github.com/stretchr/testify v1.10.0 // indirect
 
 require (
-	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.62.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
 	golang.org/x/sys v0.30.0 // indirect
+	google.golang.org/protobuf v1.36.5 // indirect
 )
+
+require example.com/alak-common v0.0.0
+
+replace example.com/alak-common => ../alak-common